@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminToken enables /api/admin when set
+var adminToken string
+
+// AdminClient describes a registered client for the operator
+type AdminClient struct {
+	Token        string  `json:"token"`
+	Peer         string  `json:"peer,omitempty"`
+	RemoteIP     string  `json:"remoteIp"`
+	Age          float64 `json:"age"` // Seconds since the token was issued
+	Reconnecting bool    `json:"reconnecting"`
+}
+
+// adminAuthorized checks for "Authorization: Bearer <admin token>"
+func adminAuthorized(r *http.Request) bool {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) == 1
+}
+
+// handleAdmin lists clients on GET
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	mutex.Lock()
+	list := make([]AdminClient, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, AdminClient{
+			Token:        client.token,
+			Peer:         client.peerToken,
+			RemoteIP:     client.remoteIP,
+			Age:          now.Sub(client.connectedAt).Seconds(),
+			Reconnecting: client.conn == nil,
+		})
+	}
+	mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Age > list[j].Age })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]AdminClient{"clients": list})
+}
+
+// handleAdminKick disconnects the client named by ?token= on POST
+func handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if !kickClient(token) {
+		http.Error(w, "No such client", http.StatusNotFound)
+		return
+	}
+	slog.Info("Client kicked by operator", "token", token, "ip", clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kickClient tells a client it was disconnected, closes its socket and
+// forgets its token so it can't be reclaimed
+func kickClient(token string) bool {
+	mutex.Lock()
+	client, exists := clients[token]
+	if !exists {
+		mutex.Unlock()
+		return false
+	}
+	conn := dropClient(client)
+	mutex.Unlock()
+
+	if conn != nil {
+		conn.closeWith(Message{
+			Type: "kicked",
+			SDP:  "Disconnected by the server operator",
+		})
+	}
+	return true
+}
+
+// dropClient unregisters a client and detaches its socket, which the caller
+// closes with a final message once the mutex is released. The caller must
+// hold the mutex.
+func dropClient(client *Client) *wsConn {
+	if client.expiry != nil {
+		client.expiry.Stop()
+		client.expiry = nil
+	}
+	// Detach so the read loop's releaseClient leaves the token alone
+	conn := client.conn
+	client.conn = nil
+	removeClient(client)
+	return conn
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Token lifetime limits, 0 disables
+var (
+	tokenTTL    time.Duration // Maximum age of a token
+	idleTimeout time.Duration // Maximum time without a signaling message other than ping
+)
+
+// sweepInterval picks how often to check for expired tokens: a quarter of
+// the shortest limit, between a second and a minute
+func sweepInterval() time.Duration {
+	interval := time.Minute
+	for _, limit := range []time.Duration{tokenTTL, idleTimeout} {
+		if limit > 0 && limit/4 < interval {
+			interval = limit / 4
+		}
+	}
+	return max(interval, time.Second)
+}
+
+// sweepClients expires tokens on every tick. It never returns.
+func sweepClients(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expireClients(now)
+	}
+}
+
+// expireClients drops clients past their token lifetime or idle limit, and
+// entries left without a connection or grace timer
+func expireClients(now time.Time) {
+	notices := make(map[*wsConn]Message)
+
+	mutex.Lock()
+	for _, client := range clients {
+		switch {
+		case client.conn == nil && client.expiry == nil:
+			slog.Warn("Removing stale client", "token", client.token)
+			removeClient(client)
+		case tokenTTL > 0 && now.Sub(client.connectedAt) > tokenTTL:
+			slog.Info("Token lifetime expired", "token", client.token)
+			if conn := dropClient(client); conn != nil {
+				notices[conn] = Message{
+					Type: "token-expired",
+					SDP:  "Token lifetime exceeded, register again",
+				}
+			}
+		case idleTimeout > 0 && now.Sub(client.lastActive) > idleTimeout:
+			slog.Info("Token idle timeout", "token", client.token)
+			if conn := dropClient(client); conn != nil {
+				notices[conn] = Message{
+					Type: "token-expired",
+					SDP:  "Token idle for too long, register again",
+				}
+			}
+		}
+	}
+	mutex.Unlock()
+
+	// A client that stopped reading mustn't hold up the others
+	for conn, notice := range notices {
+		go conn.closeWith(notice)
+	}
+}
+
+// touchClient records signaling activity for the idle timeout
+func touchClient(client *Client) {
+	mutex.Lock()
+	client.lastActive = time.Now()
+	mutex.Unlock()
+}
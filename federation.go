@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Federation lets a client pair with a token registered on another p2pftp
+// server. The home server joins the remote server as an ordinary client on
+// the requester's behalf and relays signaling over that socket, so the
+// remote server only has to answer token lookups.
+
+// federationTimeout bounds lookups and the remote registration
+const federationTimeout = 5 * time.Second
+
+// maxFederatedConnects bounds the federated lookups and dials in flight at once
+const maxFederatedConnects = 16
+
+var (
+	federatePeers    []*url.URL // Servers asked about tokens not registered here
+	federationClient = &http.Client{Timeout: federationTimeout}
+	federationSlots  = make(chan struct{}, maxFederatedConnects)
+)
+
+// errClientGone means the requester left before the remote connection was up
+var errClientGone = errors.New("client disconnected")
+
+// remotePeer is a connection to another server held for one of our clients
+type remotePeer struct {
+	conn   *wsConn
+	server string
+}
+
+// send writes a message to the remote server
+func (r *remotePeer) send(msg Message) error {
+	return r.conn.write(msg)
+}
+
+// parseFederatePeers parses the comma-separated -federate server URLs. A URL
+// may carry ?auth= for servers that require the shared secret.
+func parseFederatePeers(list string) ([]*url.URL, error) {
+	var servers []*url.URL
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		server, err := url.Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		if (server.Scheme != "http" && server.Scheme != "https") || server.Host == "" {
+			return nil, fmt.Errorf("%q is not an http or https URL", value)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// federateHosts lists the federated servers' hosts, leaving out any ?auth= secrets
+func federateHosts(servers []*url.URL) []string {
+	hosts := make([]string, len(servers))
+	for i, server := range servers {
+		hosts[i] = server.Host
+	}
+	return hosts
+}
+
+// federationEndpoint joins a path onto a federated server's URL, keeping its query
+func federationEndpoint(server *url.URL, path string) *url.URL {
+	endpoint := *server
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	return &endpoint
+}
+
+// handleLookup tells a federated server whether a token is registered here
+func handleLookup(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if connRate > 0 && !connLimiter.allow(clientIP(r)) {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	mutex.Lock()
+	_, exists := clients[r.URL.Query().Get("token")]
+	mutex.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findRemote asks each federated server for a token and returns the first
+// that has it registered
+func findRemote(token string) *url.URL {
+	for _, server := range federatePeers {
+		endpoint := federationEndpoint(server, "/api/federation/lookup")
+		query := endpoint.Query()
+		query.Set("token", token)
+		endpoint.RawQuery = query.Encode()
+
+		resp, err := federationClient.Get(endpoint.String())
+		if err != nil {
+			slog.Warn("Federation lookup failed", "server", server.Host, "error", err)
+			metrics.countError("federation")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return server
+		}
+	}
+	return nil
+}
+
+// startFederatedConnect runs connectFederated on its own goroutine so lookups
+// don't stall the client's read loop. It refuses the request when too many are
+// already in flight.
+func startFederatedConnect(client *Client, peerToken string) {
+	select {
+	case federationSlots <- struct{}{}:
+	default:
+		slog.Warn("Refusing federated connect: too many in flight", "token", client.token, "peer", peerToken)
+		client.send(Message{
+			Type: "error",
+			Code: errCodeLimited,
+			SDP:  "Server busy, try again later",
+		})
+		return
+	}
+
+	go func() {
+		defer func() { <-federationSlots }()
+		connectFederated(client, peerToken)
+	}()
+}
+
+// connectFederated sends a connection request for a token that isn't
+// registered here through the federated server that has it
+func connectFederated(client *Client, peerToken string) {
+	server := findRemote(peerToken)
+	if server == nil {
+		client.send(Message{
+			Type: "error",
+			SDP:  "Peer not found",
+		})
+		return
+	}
+
+	err := connectRemote(client, server, peerToken)
+	if errors.Is(err, errClientGone) {
+		slog.Debug("Dropping federated connection for a departed client", "token", client.token, "server", server.Host)
+		return
+	}
+	if err != nil {
+		slog.Warn("Federated connect failed", "token", client.token, "peer", peerToken, "server", server.Host, "error", err)
+		metrics.countError("federation")
+		client.send(Message{
+			Type: "error",
+			SDP:  "Could not reach the peer's server",
+		})
+	}
+}
+
+// connectRemote registers with the server holding peerToken and sends the
+// connection request from there. The requester's signed identity is not
+// passed on: it covers our client's token, which the remote peer never sees.
+func connectRemote(client *Client, server *url.URL, peerToken string) error {
+	endpoint := federationEndpoint(server, "/ws")
+	if endpoint.Scheme == "https" {
+		endpoint.Scheme = "wss"
+	} else {
+		endpoint.Scheme = "ws"
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: federationTimeout}
+	conn, _, err := dialer.Dial(endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	var registered Message
+	conn.SetReadDeadline(time.Now().Add(federationTimeout))
+	if err := conn.ReadJSON(&registered); err != nil {
+		conn.Close()
+		return err
+	}
+	if registered.Type != "token" {
+		conn.Close()
+		return errors.New("registration refused: " + registered.SDP)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	remote := &remotePeer{conn: newWSConn(conn), server: server.Host}
+	mutex.Lock()
+	// The client may have left while we were dialing; removeClient has
+	// already closed its remotes, so this one would leak
+	if current, ok := clients[client.token]; !ok || current != client {
+		mutex.Unlock()
+		remote.conn.Close()
+		return errClientGone
+	}
+	if client.remotes == nil {
+		client.remotes = make(map[string]*remotePeer)
+	}
+	if old := client.remotes[peerToken]; old != nil {
+		old.conn.Close()
+	}
+	client.remotes[peerToken] = remote
+	client.peerToken = peerToken
+	mutex.Unlock()
+
+	slog.Info("Federated connection request", "token", client.token, "peer", peerToken, "server", server.Host)
+	go relayRemote(client, peerToken, remote)
+
+	return remote.send(Message{
+		Type:      "connect",
+		PeerToken: peerToken,
+	})
+}
+
+// relayRemote passes signaling from the remote server to our client until
+// either side goes away
+func relayRemote(client *Client, peerToken string, remote *remotePeer) {
+	defer func() {
+		remote.conn.Close()
+		mutex.Lock()
+		if client.remotes[peerToken] == remote {
+			delete(client.remotes, peerToken)
+		}
+		mutex.Unlock()
+	}()
+
+	for {
+		var msg Message
+		if err := remote.conn.ws.ReadJSON(&msg); err != nil {
+			slog.Debug("Federated connection closed", "token", client.token, "server", remote.server, "error", err)
+			return
+		}
+
+		switch msg.Type {
+		case "accepted", "rejected", "offer", "answer", "ice", "error":
+			forward(client, msg)
+		}
+	}
+}
+
+// relayToRemote sends a client's offer, answer or ICE candidate on to a
+// federated server, reporting false if the peer isn't remote
+func relayToRemote(client *Client, msg Message) bool {
+	mutex.Lock()
+	remote := client.remotes[msg.PeerToken]
+	mutex.Unlock()
+
+	if remote == nil {
+		return false
+	}
+
+	msg.Token = ""
+	if err := remote.send(msg); err != nil {
+		slog.Warn("Error relaying to federated server", "token", client.token, "server", remote.server, "error", err)
+		metrics.countError("federation")
+		client.send(Message{
+			Type: "error",
+			SDP:  "Lost connection to the peer's server",
+		})
+		return true
+	}
+	metrics.countForwarded(msg.Type)
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxHistoryEntries bounds the in-memory session history; older entries are dropped
+const maxHistoryEntries = 1000
+
+// recentPairingWindow is how long an ended pairing still counts for reports,
+// so a client can report a transfer after its peer has already left
+const recentPairingWindow = 10 * time.Minute
+
+// SessionReport is sent by a client once a transfer finishes
+type SessionReport struct {
+	Direction string `json:"direction"` // "send" or "receive"
+	Bytes     int64  `json:"bytes"`
+	Duration  int64  `json:"duration"` // Milliseconds
+	Success   bool   `json:"success"`
+}
+
+// HistoryEntry is a recorded session with both tokens hashed
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Peer      string    `json:"peer,omitempty"`
+	Direction string    `json:"direction"`
+	Bytes     int64     `json:"bytes"`
+	Duration  int64     `json:"duration"`
+	Success   bool      `json:"success"`
+}
+
+// History records anonymized transfer sessions for /api/history
+type History struct {
+	mu      sync.Mutex
+	salt    []byte
+	entries []HistoryEntry
+	ended   map[string]time.Time // Recently ended pairings by pairing key
+}
+
+var history *History // nil unless enabled with -history
+
+func newHistory() *History {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &History{salt: salt, ended: make(map[string]time.Time)}
+}
+
+// hashToken anonymizes a token. The salt is per process, so hashes can be
+// correlated within a run but not reversed by enumerating short tokens.
+func (h *History) hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256(append(h.salt, token...))
+	return hex.EncodeToString(sum[:6])
+}
+
+// endPairing remembers that the pairing under key has just ended
+func (h *History) endPairing(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for k, at := range h.ended {
+		if now.Sub(at) > recentPairingWindow {
+			delete(h.ended, k)
+		}
+	}
+	h.ended[key] = now
+}
+
+// recentlyPaired reports whether the pairing under key ended within
+// recentPairingWindow
+func (h *History) recentlyPaired(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	at, ok := h.ended[key]
+	return ok && time.Since(at) <= recentPairingWindow
+}
+
+// record stores a report from client about its session with peerToken. It
+// ignores malformed reports and any from a client not paired with that peer,
+// now or within recentPairingWindow, and reports whether the entry was kept.
+func (h *History) record(client *Client, peerToken string, report *SessionReport) bool {
+	if report == nil || report.Bytes < 0 || report.Duration < 0 ||
+		(report.Direction != "send" && report.Direction != "receive") {
+		return false
+	}
+
+	mutex.Lock()
+	token := client.token
+	key := pairingKey(token, peerToken)
+	_, paired := pairings[key]
+	paired = peerToken != "" && (paired || client.remotes[peerToken] != nil || h.recentlyPaired(key))
+	mutex.Unlock()
+	if !paired {
+		return false
+	}
+
+	entry := HistoryEntry{
+		Time:      time.Now().UTC(),
+		Client:    h.hashToken(token),
+		Peer:      h.hashToken(peerToken),
+		Direction: report.Direction,
+		Bytes:     report.Bytes,
+		Duration:  report.Duration,
+		Success:   report.Success,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistoryEntries {
+		h.entries = h.entries[len(h.entries)-maxHistoryEntries:]
+	}
+	return true
+}
+
+// handleHistory serves the recorded sessions, oldest first, to the operator
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	history.mu.Lock()
+	entries := make([]HistoryEntry, len(history.entries))
+	copy(entries, history.entries)
+	history.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]HistoryEntry{"sessions": entries})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Abuse limits, 0 means unlimited
+var (
+	authToken      string  // Shared secret clients present as ?auth=
+	maxMessageSize int64   // Largest signaling frame accepted, in bytes
+	connRate       float64 // New WebSocket connections per minute per IP
+	msgRate        float64 // Signaling messages per second per client
+	connectRate    float64 // Peer connection requests per minute per client
+	trustProxy     bool    // Take the client IP from X-Forwarded-For
+	proxyHops      int     // Trusted proxies in front of the server, counted from the right
+)
+
+// idleLimiterTime is how long per-IP state is kept after the last connection
+const idleLimiterTime = 10 * time.Minute
+
+// tokenBucket allows bursts of up to burst events, refilled at rate per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	// Fractional rates would otherwise give a burst below one event, which
+	// never allows anything
+	burst = math.Max(1, burst)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ipLimiter keeps one token bucket per client IP
+type ipLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var connLimiter = &ipLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow reports whether ip may open another connection
+func (l *ipLimiter) allow(ip string) bool {
+	if connRate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = newTokenBucket(connRate/60, connRate)
+		l.buckets[ip] = bucket
+	}
+	return bucket.allow()
+}
+
+// prune drops buckets that have been idle long enough to be full again
+func (l *ipLimiter) prune() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, bucket := range l.buckets {
+			if time.Since(bucket.last) > idleLimiterTime {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientIP returns the address to rate limit a request by
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		// Clients can put anything at the start of the header; only the
+		// entries appended by our own proxies can be believed
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(strings.Join(forwarded, ","), ",")
+			// Too few entries means the header didn't pass through all of
+			// our proxies, so none of it can be trusted
+			if i := len(addrs) - proxyHops; i >= 0 {
+				return strings.TrimSpace(addrs[i])
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authorized checks the shared secret, if one is configured
+func authorized(r *http.Request) bool {
+	if authToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("auth")), []byte(authToken)) == 1
+}
+
+// Session reports are capped even when -msg-rate is unlimited, since each
+// one takes a slot in the shared history
+const (
+	reportRate  = 1.0 / 6 // Per second
+	reportBurst = 10
+)
+
+// clientLimits holds the per-connection message buckets
+type clientLimits struct {
+	messages *tokenBucket
+	connects *tokenBucket
+	reports  *tokenBucket
+}
+
+func newClientLimits() *clientLimits {
+	limits := &clientLimits{reports: newTokenBucket(reportRate, reportBurst)}
+	if msgRate > 0 {
+		limits.messages = newTokenBucket(msgRate, 2*msgRate)
+	}
+	if connectRate > 0 {
+		limits.connects = newTokenBucket(connectRate/60, connectRate)
+	}
+	return limits
+}
+
+// allow reports whether a message of the given type is within the limits
+func (l *clientLimits) allow(msgType string) bool {
+	if l.messages != nil && !l.messages.allow() {
+		return false
+	}
+	if msgType == "connect" && l.connects != nil && !l.connects.allow() {
+		return false
+	}
+	if msgType == "session-report" && !l.reports.allow() {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFlags collects repeated -listen values
+type listenFlags []string
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// openListeners returns the sockets systemd passed us, if any, and otherwise
+// opens each address: host:port for TCP, unix:/path for a Unix socket
+func openListeners(addrs []string) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	for _, addr := range addrs {
+		listener, err := listen(addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// Clear a socket left behind by a previous run, but nothing else
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdListeners implements the socket activation protocol: inherited
+// sockets start at fd 3, and LISTEN_PID guards against inheriting them by
+// accident
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("LISTEN_FDS is not a positive number")
+	}
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := 3; fd < 3+count; fd++ {
+		file := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	slog.Info("Using systemd socket activation", "sockets", count)
+	return listeners, nil
+}
+
+// serve runs the HTTP server on every listener and returns when one fails
+func serve(listeners []net.Listener, tlsCert, tlsKey string) error {
+	scheme := "http"
+	if tlsCert != "" {
+		scheme = "https"
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		address := listener.Addr()
+		slog.Info("Listening", "network", address.Network(), "addr", address.String())
+		if address.Network() == "tcp" {
+			slog.Info("Web interface", "url", scheme+"://"+address.String()+"/")
+		}
+
+		go func(listener net.Listener) {
+			if tlsCert != "" {
+				errs <- http.ServeTLS(listener, nil, tlsCert, tlsKey)
+			} else {
+				errs <- http.Serve(listener, nil)
+			}
+		}(listener)
+	}
+	return <-errs
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -18,25 +31,154 @@ import (
 //go:embed web/static
 var staticFiles embed.FS
 
+// maxPendingMessages bounds how many messages are held for a client that is
+// inside its reconnect grace period
+const maxPendingMessages = 64
+
+// maxTokenAttempts bounds how many tokens are drawn before registration
+// gives up on finding an unused one
+const maxTokenAttempts = 10
+
+// wsConn serializes writes to one WebSocket and bounds each with a
+// deadline, so a peer that stops reading only stalls messages addressed to it
+type wsConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+// write sends a message, giving up after writeWait. Never call it with the
+// server mutex held.
+func (c *wsConn) write(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeLocked(msg)
+}
+
+// writeLocked is write for callers already holding writeMu. A failed write
+// leaves the socket unusable, so it is closed and the read loop winds down.
+func (c *wsConn) writeLocked(msg Message) error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.ws.Close()
+		return err
+	}
+	return nil
+}
+
+// closeWith sends a final message and closes the socket
+func (c *wsConn) closeWith(notice Message) {
+	c.write(notice)
+	c.ws.Close()
+}
+
+// Close closes the socket without waiting on writes, so it is safe under the mutex
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
 // Client represents a connected user
 type Client struct {
-	conn      *websocket.Conn
+	conn      *wsConn // nil while the client is reconnecting
 	token     string
 	peerToken string
+	secret    string    // Presented by the client to reclaim its token
+	pending   []Message // Messages queued while disconnected
+	expiry    *time.Timer
+
+	// Reported by the admin API
+	remoteIP    string
+	connectedAt time.Time // When the token was issued
+
+	lastActive time.Time // Last signaling message other than ping
+
+	remotes map[string]*remotePeer // Federated servers relaying to peers, by peer token
+}
+
+// send delivers a message to the client, queueing it while the client is
+// inside its reconnect grace period. The write itself happens outside the
+// mutex, serialized per connection.
+func (c *Client) send(msg Message) error {
+	mutex.Lock()
+	conn := c.conn
+	if conn == nil {
+		defer mutex.Unlock()
+		if len(c.pending) >= maxPendingMessages {
+			return fmt.Errorf("pending queue full for %s", c.token)
+		}
+		c.pending = append(c.pending, msg)
+		return nil
+	}
+	mutex.Unlock()
+
+	if err := conn.write(msg); err != nil {
+		metrics.countError("write")
+		return err
+	}
+	return nil
 }
 
 // Message represents the WebSocket message structure
 type Message struct {
-	Type      string `json:"type"`
-	Token     string `json:"token,omitempty"`
-	PeerToken string `json:"peerToken,omitempty"`
-	SDP       string `json:"sdp,omitempty"`
-	ICE       string `json:"ice,omitempty"`
+	Type      string         `json:"type"`
+	Token     string         `json:"token,omitempty"`
+	PeerToken string         `json:"peerToken,omitempty"`
+	SDP       string         `json:"sdp,omitempty"`
+	ICE       string         `json:"ice,omitempty"`
+	Secret    string         `json:"secret,omitempty"`
+	Code      string         `json:"code,omitempty"`   // Machine-readable error code
+	Report    *SessionReport `json:"report,omitempty"` // Set on session-report
+
+	// Peer capabilities relayed untouched with an offer or answer
+	Capabilities json.RawMessage `json:"capabilities,omitempty"`
+
+	// Requester's signed identity relayed untouched with a connection request
+	Identity json.RawMessage `json:"identity,omitempty"`
+}
+
+// WebSocket keepalive timing
+const (
+	pongWait   = 60 * time.Second    // Drop a connection silent for this long
+	pingPeriod = (pongWait * 9) / 10 // Must be shorter than pongWait
+	writeWait  = 10 * time.Second
+)
+
+// Error codes sent in Message.Code
+const (
+	errCodeServerFull = "server-full"
+	errCodeLimited    = "rate-limited"
+	errCodeNotPaired  = "not-paired"
+)
+
+// TurnServer represents a TURN relay and the credentials to use it
+type TurnServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
 }
 
 // ConfigResponse represents the configuration returned to clients
 type ConfigResponse struct {
-	StunServers []string `json:"stunServers"`
+	StunServers []string     `json:"stunServers"`
+	TurnServers []TurnServer `json:"turnServers,omitempty"`
+
+	// SignedConfig is the JSON-encoded ICE server list covered by Signature.
+	// Clients that pin the operator key use it instead of the fields above.
+	SignedConfig string `json:"signedConfig,omitempty"`
+	Signature    string `json:"signature,omitempty"`
+
+	// History tells clients to keep their signaling connection open after
+	// the peer-to-peer link is up, so they can still send session reports
+	History bool `json:"history,omitempty"`
+}
+
+// ICEConfig is the part of the configuration that gets signed
+type ICEConfig struct {
+	StunServers []string     `json:"stunServers"`
+	TurnServers []TurnServer `json:"turnServers,omitempty"`
 }
 
 var (
@@ -46,24 +188,130 @@ var (
 			return true // Allow all origins for testing
 		},
 	}
-	mutex      = &sync.Mutex{}
-	stunServers []string
+	mutex          = &sync.Mutex{}
+	stunServers    []string
+	turnServers    []TurnServer
+	reconnectGrace time.Duration
+
+	// Token format
+	tokenLength int
+	tokenWords  bool
+
+	// Capacity limits, 0 means unlimited
+	maxClients  int
+	maxPairings int
+	pairings    = make(map[string]struct{}) // Accepted pairs, keyed by pairingKey
+
+	signedConfig    string
+	configSignature string
 )
 
 func handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ConfigResponse{
+		StunServers:  stunServers,
+		TurnServers:  turnServers,
+		SignedConfig: signedConfig,
+		Signature:    configSignature,
+		History:      history != nil,
+	})
+}
+
+// loadSigningKey reads a PKCS#8 PEM Ed25519 private key, as produced by
+// "openssl genpkey -algorithm ed25519"
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", key)
+	}
+	return edKey, nil
+}
+
+// signICEConfig signs the ICE server list so clients that pin the operator
+// key can detect a tampered /api/config response
+func signICEConfig(key ed25519.PrivateKey) error {
+	payload, err := json.Marshal(ICEConfig{
 		StunServers: stunServers,
+		TurnServers: turnServers,
 	})
+	if err != nil {
+		return err
+	}
+
+	signedConfig = string(payload)
+	configSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
 }
 
 func main() {
 	// Parse command line arguments
 	addr := flag.String("addr", "localhost", "Listen address")
 	port := flag.Int("port", 8089, "Listen port")
+	var listenAddrs listenFlags
+	flag.Var(&listenAddrs, "listen", "Address to listen on, host:port or unix:/path; repeat for several (overrides -addr and -port)")
 	stunFlag := flag.String("stun", "", "Comma-separated list of STUN servers (default: Google STUN servers)")
+	turnFlag := flag.String("turn", "", "Comma-separated list of TURN server URLs (default: none)")
+	turnUser := flag.String("turn-username", "", "Username for the TURN servers")
+	turnCredential := flag.String("turn-credential", "", "Credential for the TURN servers")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM); serves HTTPS/WSS when set with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+	configKey := flag.String("config-key", "", "PEM Ed25519 private key used to sign the ICE server list (default: unsigned)")
+	flag.IntVar(&maxClients, "max-clients", 0, "Maximum registered clients (0 for unlimited)")
+	flag.IntVar(&maxPairings, "max-pairings", 0, "Maximum concurrent peer pairings (0 for unlimited)")
+	flag.StringVar(&authToken, "auth-token", "", "Shared secret clients must present as ?auth= to connect (default: open)")
+	flag.Int64Var(&maxMessageSize, "max-message-size", 64*1024, "Largest signaling message accepted, in bytes")
+	flag.Float64Var(&connRate, "conn-rate", 0, "New WebSocket connections allowed per minute per IP (0 for unlimited)")
+	flag.Float64Var(&msgRate, "msg-rate", 0, "Signaling messages allowed per second per client (0 for unlimited)")
+	flag.Float64Var(&connectRate, "connect-rate", 0, "Peer connection requests allowed per minute per client (0 for unlimited)")
+	flag.BoolVar(&trustProxy, "trust-proxy", false, "Take client addresses for logging and rate limiting from the X-Forwarded-For header set by a reverse proxy")
+	flag.IntVar(&proxyHops, "proxy-hops", 1, "Number of trusted reverse proxies appending to X-Forwarded-For when -trust-proxy is set")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token for the /api/admin client list and kick endpoints (default: disabled)")
+	federateFlag := flag.String("federate", "", "Comma-separated URLs of p2pftp servers to ask about tokens not registered here (default: none)")
+	historyFlag := flag.Bool("history", false, "Record anonymized transfer session reports and serve them on /api/history (requires -admin-token)")
+	flag.IntVar(&tokenLength, "token-length", 8, "Length of generated hex tokens (4-32)")
+	flag.BoolVar(&tokenWords, "token-words", false, "Generate human-friendly word tokens such as quiet-amber-lion-4821 (about 34 bits, easier to guess than longer hex tokens)")
+	flag.DurationVar(&reconnectGrace, "reconnect-grace", 60*time.Second, "How long a disconnected client can reclaim its token (0 to disable)")
+	flag.DurationVar(&tokenTTL, "token-ttl", 0, "Maximum lifetime of a token before the client must register again (0 for unlimited)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Expire tokens that send no signaling messages for this long (0 to disable)")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
 	flag.Parse()
 
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal("Invalid logging flags", "error", err)
+	}
+
+	if tokenLength < 4 || tokenLength > 32 {
+		fatal("-token-length must be between 4 and 32")
+	}
+
+	if proxyHops < 1 {
+		fatal("-proxy-hops must be at least 1")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	if tokenTTL < 0 || idleTimeout < 0 {
+		fatal("-token-ttl and -idle-timeout can't be negative")
+	}
+
 	// Set STUN servers
 	if *stunFlag != "" {
 		stunServers = strings.Split(*stunFlag, ",")
@@ -81,16 +329,79 @@ func main() {
 		}
 	}
 
+	// Set TURN servers
+	if *turnFlag != "" {
+		urls := strings.Split(*turnFlag, ",")
+		for i, url := range urls {
+			urls[i] = strings.TrimSpace(url)
+		}
+		turnServers = []TurnServer{{
+			URLs:       urls,
+			Username:   *turnUser,
+			Credential: *turnCredential,
+		}}
+		slog.Info("Using TURN servers", "urls", strings.Join(urls, ", "))
+	}
+
+	// Sign the ICE configuration if an operator key was given
+	if *configKey != "" {
+		key, err := loadSigningKey(*configKey)
+		if err != nil {
+			fatal("Failed to load config signing key", "error", err)
+		}
+		if err := signICEConfig(key); err != nil {
+			fatal("Failed to sign ICE configuration", "error", err)
+		}
+		publicKey := key.Public().(ed25519.PublicKey)
+		slog.Info("Signing ICE configuration, clients can pin it with ?configkey=", "key", base64.RawURLEncoding.EncodeToString(publicKey))
+	}
+
 	// Set up config endpoint
 	http.HandleFunc("/api/config", handleConfig)
 
+	// Set up operator metrics
+	http.HandleFunc("/metrics", handleMetrics)
+
+	// Set up federation, if enabled. Lookups are answered only when this
+	// server federates too.
+	if *federateFlag != "" {
+		servers, err := parseFederatePeers(*federateFlag)
+		if err != nil {
+			fatal("Invalid -federate servers", "error", err)
+		}
+		federatePeers = servers
+		http.HandleFunc("/api/federation/lookup", handleLookup)
+		slog.Info("Federating with other servers", "servers", federateHosts(servers))
+	}
+
+	// Set up the transfer history, if enabled
+	if *historyFlag {
+		if adminToken == "" {
+			fatal("-history requires -admin-token")
+		}
+		history = newHistory()
+		http.HandleFunc("/api/history", handleHistory)
+		slog.Info("Recording transfer history, served on /api/history")
+	}
+
+	// Set up the operator API, if enabled
+	if adminToken != "" {
+		http.HandleFunc("/api/admin", handleAdmin)
+		http.HandleFunc("/api/admin/kick", handleAdminKick)
+		slog.Info("Admin API enabled on /api/admin")
+	}
+
 	// Set up WebSocket route
 	http.HandleFunc("/ws", handleConnections)
+	if connRate > 0 {
+		go connLimiter.prune()
+	}
+	go sweepClients(sweepInterval())
 
 	// Set up static file server for web client
 	staticFS, err := fs.Sub(staticFiles, "web/static")
 	if err != nil {
-		log.Fatal("Failed to create sub filesystem:", err)
+		fatal("Failed to create sub filesystem", "error", err)
 	}
 
 	// Handle root path explicitly to avoid redirect loops
@@ -100,7 +411,7 @@ func main() {
 			content, err := fs.ReadFile(staticFS, "index.html")
 			if err != nil {
 				http.Error(w, "Could not read index.html", http.StatusInternalServerError)
-				log.Printf("Error reading index.html: %v", err)
+				slog.Error("Error reading index.html", "error", err)
 				return
 			}
 
@@ -134,60 +445,163 @@ func main() {
 	})
 
 	// Start the server
-	listenAddr := fmt.Sprintf("%s:%d", *addr, *port)
-	log.Printf("P2PFTP Server starting on %s", listenAddr)
-	log.Printf("Web interface: http://%s/", listenAddr)
-	log.Printf("WebSocket endpoint: ws://%s/ws", listenAddr)
-
-	err = http.ListenAndServe(listenAddr, nil)
+	if len(listenAddrs) == 0 {
+		listenAddrs = listenFlags{net.JoinHostPort(*addr, strconv.Itoa(*port))}
+	}
+	listeners, err := openListeners(listenAddrs)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		fatal("Failed to listen", "error", err)
+	}
+
+	slog.Info("P2PFTP Server starting")
+	if err := serve(listeners, *tlsCert, *tlsKey); err != nil {
+		fatal("Server stopped", "error", err)
 	}
 }
 
 func handleConnections(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Starting websocket for %s", r.Header.Get("X-Forwarded-For"))
+	ip := clientIP(r)
+	slog.Debug("Starting websocket", "ip", ip)
+
+	// Refuse before upgrading so rejected clients cost as little as possible
+	if !authorized(r) {
+		slog.Warn("Refusing connection without a valid auth token", "ip", ip)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !connLimiter.allow(ip) {
+		slog.Warn("Rate limiting connections", "ip", ip)
+		http.Error(w, "Too many connections, try again later", http.StatusTooManyRequests)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Error upgrading to WebSocket:", err)
+		slog.Warn("Error upgrading to WebSocket", "ip", ip, "error", err)
+		metrics.countError("upgrade")
 		return
 	}
 	defer conn.Close()
+	if maxMessageSize > 0 {
+		conn.SetReadLimit(maxMessageSize)
+	}
 
-	// Generate a token for this client
-	token := generateToken()
-	client := &Client{
-		conn:  conn,
-		token: token,
+	// Reclaim a token held within its grace period, otherwise register anew
+	socket := newWSConn(conn)
+	query := r.URL.Query()
+	client, err := reclaimClient(query.Get("token"), query.Get("secret"), socket, ip)
+	if err != nil {
+		slog.Warn("Error resuming client", "token", query.Get("token"), "error", err)
+		return
 	}
 
-	// Register the client
-	mutex.Lock()
-	clients[token] = client
-	mutex.Unlock()
+	if client == nil {
+		now := time.Now()
+		client = &Client{
+			conn:        socket,
+			secret:      generateSecret(),
+			remoteIP:    ip,
+			connectedAt: now,
+			lastActive:  now,
+		}
 
-	// Send the token to the client
-	if err := conn.WriteJSON(Message{
-		Type:  "token",
-		Token: token,
-	}); err != nil {
-		log.Println("Error sending token:", err)
-		return
+		// Register the client under an unused token unless the server is at capacity
+		mutex.Lock()
+		registered := len(clients)
+		full := maxClients > 0 && registered >= maxClients
+		if !full {
+			client.token, err = uniqueToken()
+			if err == nil {
+				clients[client.token] = client
+			}
+		}
+		mutex.Unlock()
+
+		if err != nil {
+			slog.Error("Error registering client", "ip", ip, "error", err)
+			socket.write(Message{
+				Type: "error",
+				SDP:  "Could not assign a token, try again later",
+			})
+			return
+		}
+
+		if full {
+			slog.Warn("Rejecting registration: server full", "ip", ip, "clients", registered, "limit", maxClients)
+			socket.write(Message{
+				Type: "error",
+				Code: errCodeServerFull,
+				SDP:  "Server full: too many connected clients, try again later",
+			})
+			return
+		}
+
+		// Send the token to the client
+		if err := client.send(Message{
+			Type:   "token",
+			Token:  client.token,
+			Secret: client.secret,
+		}); err != nil {
+			slog.Warn("Error sending token", "token", client.token, "error", err)
+			return
+		}
 	}
 
+	// Detect dead connections: any frame or pong extends the read deadline
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(conn, done)
+
+	logger := slog.With("token", client.token)
+	logger.Info("Client connected", "ip", ip)
+
 	// Handle WebSocket messages
+	limits := newClientLimits()
 	for {
 		var msg Message
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			log.Println("Error reading message:", err)
-			break
+			clean := websocket.IsCloseError(err, websocket.CloseNormalClosure)
+			if clean {
+				logger.Info("Client disconnected")
+			} else {
+				logger.Warn("Error reading message", "error", err)
+				metrics.countError("read")
+			}
+			releaseClient(client, socket, clean)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		metrics.countReceived(msg.Type)
+		logger.Debug("Received message", "type", msg.Type, "peer", msg.PeerToken)
+
+		if !limits.allow(msg.Type) {
+			logger.Warn("Rate limiting messages", "type", msg.Type)
+			client.send(Message{
+				Type: "error",
+				Code: errCodeLimited,
+				SDP:  "Slow down: too many signaling messages",
+			})
+			continue
+		}
+
+		// Keepalives don't count as activity, or the idle timeout would never fire
+		if msg.Type != "ping" {
+			touchClient(client)
 		}
 
 		switch msg.Type {
+		case "ping":
+			// Application-level keepalive for browsers, which can't see WebSocket pings
+			client.send(Message{Type: "pong"})
 		case "connect":
-			handleConnect(client, msg.PeerToken)
+			handleConnect(client, msg.PeerToken, msg.Identity)
 		case "accept":
 			handleAccept(client, msg.PeerToken)
 		case "reject":
@@ -198,59 +612,341 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 			forwardOffer(client, msg)
 		case "answer":
 			forwardAnswer(client, msg)
+		case "session-report":
+			if history != nil {
+				if !history.record(client, msg.PeerToken, msg.Report) {
+					logger.Debug("Ignoring session report", "peer", msg.PeerToken)
+				} else {
+					logger.Debug("Session report", "direction", msg.Report.Direction, "bytes", msg.Report.Bytes, "success", msg.Report.Success)
+				}
+			}
 		}
 	}
+}
+
+// keepAlive pings the connection until done is closed or a ping fails
+func keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// WriteControl is safe to call concurrently with other writes
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				slog.Debug("Error sending ping", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// reclaimClient rebinds a token to a new connection if the secret matches.
+// It returns nil when there is nothing to reclaim.
+func reclaimClient(token, secret string, conn *wsConn, ip string) (*Client, error) {
+	if token == "" || secret == "" {
+		return nil, nil
+	}
 
-	// Unregister client when disconnected
 	mutex.Lock()
-	delete(clients, client.token)
+	client, exists := clients[token]
+	if !exists || subtle.ConstantTimeCompare([]byte(client.secret), []byte(secret)) != 1 {
+		mutex.Unlock()
+		return nil, nil
+	}
+
+	if client.expiry != nil {
+		client.expiry.Stop()
+		client.expiry = nil
+	}
+
+	// A stale connection the server hasn't noticed yet is replaced
+	stale := client.conn
+	client.conn = conn
+	client.remoteIP = ip
+	client.lastActive = time.Now()
+	pending := client.pending
+	client.pending = nil
+
+	// Hold the new socket's write lock until the backlog is out, so nothing
+	// sent meanwhile overtakes it. Nobody else has the socket yet, so this
+	// doesn't block under the mutex.
+	conn.writeMu.Lock()
 	mutex.Unlock()
+
+	if stale != nil {
+		stale.Close()
+	}
+	slog.Info("Client reconnected", "token", token, "queued", len(pending))
+
+	err := conn.writeLocked(Message{
+		Type:   "token",
+		Token:  client.token,
+		Secret: client.secret,
+	})
+	sent := 0
+	for ; err == nil && sent < len(pending); sent++ {
+		err = conn.writeLocked(pending[sent])
+	}
+	conn.writeMu.Unlock()
+
+	if err != nil {
+		// Keep what didn't go out for the next reconnect
+		mutex.Lock()
+		if client.conn == conn {
+			client.pending = append(pending[sent:], client.pending...)
+		}
+		mutex.Unlock()
+		releaseClient(client, conn, false)
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// releaseClient detaches a closed connection from its client. Unless the
+// client closed cleanly, the token is held for the reconnect grace period.
+func releaseClient(client *Client, conn *wsConn, clean bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// The client already reconnected on another socket
+	if client.conn != conn {
+		return
+	}
+	client.conn = nil
+
+	if clean || reconnectGrace <= 0 {
+		removeClient(client)
+		return
+	}
+
+	client.expiry = time.AfterFunc(reconnectGrace, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if client.conn == nil && clients[client.token] == client {
+			slog.Info("Reconnect grace expired", "token", client.token)
+			removeClient(client)
+		}
+	})
+}
+
+// removeClient unregisters a client and drops its pairings. The caller must
+// hold the mutex.
+func removeClient(client *Client) {
+	delete(clients, client.token)
+	unpair(client.token)
+	for _, remote := range client.remotes {
+		remote.conn.Close()
+	}
+	client.remotes = nil
+}
+
+// unpair ends every pairing that involves token. The caller must hold mutex.
+func unpair(token string) {
+	for key := range pairings {
+		tokens := strings.SplitN(key, ":", 2)
+		if tokens[0] == token || tokens[1] == token {
+			delete(pairings, key)
+			if history != nil {
+				history.endPairing(key)
+			}
+		}
+	}
+}
+
+// pairingKey identifies a pair of clients regardless of who initiated
+func pairingKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// uniqueToken draws tokens until one is not registered. Must be called with
+// the mutex held.
+func uniqueToken() (string, error) {
+	for i := 0; i < maxTokenAttempts; i++ {
+		token := generateToken()
+		if _, taken := clients[token]; !taken {
+			return token, nil
+		}
+		slog.Debug("Token collision, retrying", "token", token)
+	}
+	return "", errors.New("no unused token found")
 }
 
 func generateToken() string {
-	return uuid.New().String()[:8]
+	if tokenWords {
+		return generateWordToken()
+	}
+	b := make([]byte, (tokenLength+1)/2)
+	if _, err := rand.Read(b); err != nil {
+		return strings.ReplaceAll(uuid.New().String(), "-", "")[:tokenLength]
+	}
+	return hex.EncodeToString(b)[:tokenLength]
+}
+
+// Word tokens are two adjectives, a noun and four digits: 128^3 * 10^4,
+// about 34 bits, a little more than the default 8 hex digits. Fewer words
+// would make tokens easy to enumerate through connect requests and
+// federation lookups.
+var (
+	tokenAdjectives = []string{
+		"amber", "ancient", "arctic", "autumn", "bold", "brave", "breezy", "bright",
+		"brisk", "bronze", "bubbly", "calm", "candid", "cheerful", "clever", "cobalt",
+		"cosmic", "cozy", "crimson", "crisp", "curious", "dapper", "daring", "dawn",
+		"dreamy", "dusty", "eager", "early", "earnest", "electric", "elegant", "emerald",
+		"fair", "fancy", "fearless", "festive", "fluffy", "frosty", "gallant", "gentle",
+		"giant", "glad", "gleaming", "golden", "graceful", "grand", "happy", "hardy",
+		"hasty", "hidden", "humble", "icy", "idle", "indigo", "ivory", "jade",
+		"jolly", "jovial", "keen", "kind", "lavish", "lazy", "lemon", "lively",
+		"loyal", "lucky", "lunar", "magic", "marble", "mellow", "merry", "mighty",
+		"misty", "modest", "nimble", "noble", "northern", "odd", "olive", "orange",
+		"patient", "plucky", "polar", "polite", "proud", "purple", "quick", "quiet",
+		"radiant", "rapid", "rosy", "royal", "rusty", "sandy", "scarlet", "serene",
+		"shady", "shiny", "shy", "silent", "silky", "silver", "sleepy", "smooth",
+		"snowy", "solar", "spicy", "steady", "stormy", "sturdy", "sunny", "swift",
+		"tame", "tawny", "tender", "tidy", "tiny", "tranquil", "velvet", "vivid",
+		"warm", "wild", "windy", "wise", "witty", "woolly", "young", "zesty",
+	}
+	tokenNouns = []string{
+		"acorn", "anchor", "antelope", "apple", "arrow", "aspen", "badger", "bamboo",
+		"banjo", "basil", "beacon", "bear", "beetle", "birch", "bison", "breeze",
+		"brook", "cactus", "canyon", "castle", "cedar", "cherry", "cloud", "clover",
+		"cobra", "comet", "coral", "cougar", "crane", "cricket", "daisy", "delta",
+		"dolphin", "dragon", "dune", "eagle", "echo", "elm", "ember", "falcon",
+		"feather", "fern", "fig", "finch", "fjord", "flame", "fox", "gecko",
+		"geyser", "glacier", "grove", "gull", "harbor", "hawk", "hazel", "heron",
+		"hill", "iris", "island", "ivy", "jaguar", "kettle", "kite", "koala",
+		"lagoon", "lake", "lantern", "lark", "lemur", "lily", "lion", "llama",
+		"lotus", "lynx", "maple", "meadow", "meteor", "mole", "moon", "moose",
+		"moss", "nebula", "newt", "oak", "ocean", "orchid", "osprey", "otter",
+		"owl", "panda", "parrot", "peach", "pebble", "pelican", "pepper", "pine",
+		"planet", "plum", "pond", "poppy", "puffin", "quail", "rabbit", "raven",
+		"reef", "river", "robin", "rocket", "salmon", "sparrow", "spruce", "squid",
+		"star", "stone", "summit", "swan", "thistle", "tiger", "trout", "tulip",
+		"valley", "walrus", "whale", "willow", "wolf", "wren", "yak", "zebra",
+	}
+)
+
+// generateWordToken returns a token like quiet-amber-lion-4821
+func generateWordToken() string {
+	pick := func(n int) int {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return int(uuid.New().ID() % uint32(n))
+		}
+		return int(v.Int64())
+	}
+	return fmt.Sprintf("%s-%s-%s-%04d",
+		tokenAdjectives[pick(len(tokenAdjectives))],
+		tokenAdjectives[pick(len(tokenAdjectives))],
+		tokenNouns[pick(len(tokenNouns))],
+		pick(10000))
+}
+
+func generateSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to a random UUID if the system RNG is unavailable
+		return strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+	return hex.EncodeToString(b)
 }
 
-func handleConnect(client *Client, peerToken string) {
-	// Find the peer client
+func handleConnect(client *Client, peerToken string, identity json.RawMessage) {
+	// A new request ends any session the client was still paired in, so
+	// stale pairings don't count toward -max-pairings
 	mutex.Lock()
+	unpair(client.token)
 	peerClient, exists := clients[peerToken]
 	mutex.Unlock()
 
+	// The token may be registered on a federated server
+	if !exists && len(federatePeers) > 0 {
+		startFederatedConnect(client, peerToken)
+		return
+	}
+
 	if !exists {
 		// Peer not found
-		client.conn.WriteJSON(Message{
+		client.send(Message{
 			Type: "error",
 			SDP:  "Peer not found",
 		})
 		return
 	}
 
-	// Store the peer token
+	// Store the peer token, which the peer's accept or reject must match
+	mutex.Lock()
 	client.peerToken = peerToken
+	mutex.Unlock()
 
 	// Notify the peer about the connection request
-	peerClient.conn.WriteJSON(Message{
-		Type:  "request",
-		Token: client.token,
+	forward(peerClient, Message{
+		Type:     "request",
+		Token:    client.token,
+		Identity: identity,
 	})
 }
 
 func handleAccept(client *Client, peerToken string) {
 	mutex.Lock()
 	peerClient, exists := clients[peerToken]
+	requested := exists && peerClient.peerToken == client.token
 	mutex.Unlock()
 
 	if !exists {
-		client.conn.WriteJSON(Message{
+		client.send(Message{
 			Type: "error",
 			SDP:  "Peer not found",
 		})
 		return
 	}
 
+	// Only a pending request can be accepted
+	if !requested {
+		slog.Warn("Ignoring accept without a request", "token", client.token, "peer", peerToken)
+		client.send(Message{
+			Type: "error",
+			Code: errCodeNotPaired,
+			SDP:  "No connection request from that peer",
+		})
+		return
+	}
+
+	// Record the pairing unless the server is at capacity. It replaces any
+	// earlier pairing of the accepting client.
+	key := pairingKey(client.token, peerToken)
+	mutex.Lock()
+	_, paired := pairings[key]
+	if !paired {
+		unpair(client.token)
+	}
+	full := !paired && maxPairings > 0 && len(pairings) >= maxPairings
+	if !full {
+		pairings[key] = struct{}{}
+	}
+	mutex.Unlock()
+
+	if full {
+		slog.Warn("Rejecting pairing: limit reached", "token", client.token, "peer", peerToken, "limit", maxPairings)
+		serverFull := Message{
+			Type: "error",
+			Code: errCodeServerFull,
+			SDP:  "Server full: too many active connections, try again later",
+		}
+		client.send(serverFull)
+		peerClient.send(serverFull)
+		return
+	}
+
 	// Notify the original client that the connection was accepted
-	peerClient.conn.WriteJSON(Message{
+	forward(peerClient, Message{
 		Type:  "accepted",
 		Token: client.token,
 	})
@@ -259,76 +955,100 @@ func handleAccept(client *Client, peerToken string) {
 func handleReject(client *Client, peerToken string) {
 	mutex.Lock()
 	peerClient, exists := clients[peerToken]
+	requested := exists && peerClient.peerToken == client.token
 	mutex.Unlock()
 
-	if !exists {
+	if !requested {
 		return
 	}
 
 	// Notify the original client that the connection was rejected
-	peerClient.conn.WriteJSON(Message{
+	forward(peerClient, Message{
 		Type:  "rejected",
 		Token: client.token,
 	})
 }
 
-func forwardOffer(client *Client, msg Message) {
+// pairedPeer looks up the peer a signaling message is addressed to. Offers,
+// answers and ICE candidates are only relayed between accepted pairs; anything
+// else gets an error and is dropped.
+func pairedPeer(client *Client, peerToken string) (*Client, bool) {
 	mutex.Lock()
-	peerClient, exists := clients[msg.PeerToken]
+	peerClient, exists := clients[peerToken]
+	_, paired := pairings[pairingKey(client.token, peerToken)]
 	mutex.Unlock()
 
 	if !exists {
-		client.conn.WriteJSON(Message{
+		client.send(Message{
 			Type: "error",
 			SDP:  "Peer not found",
 		})
+		return nil, false
+	}
+
+	if !paired {
+		slog.Warn("Dropping signaling for an unpaired peer", "token", client.token, "peer", peerToken)
+		client.send(Message{
+			Type: "error",
+			Code: errCodeNotPaired,
+			SDP:  "Not paired with that peer",
+		})
+		return nil, false
+	}
+
+	return peerClient, true
+}
+
+func forwardOffer(client *Client, msg Message) {
+	if relayToRemote(client, msg) {
+		return
+	}
+
+	peerClient, ok := pairedPeer(client, msg.PeerToken)
+	if !ok {
 		return
 	}
 
 	// Forward the offer to the peer
-	peerClient.conn.WriteJSON(Message{
-		Type:  "offer",
-		Token: client.token,
-		SDP:   msg.SDP,
+	forward(peerClient, Message{
+		Type:         "offer",
+		Token:        client.token,
+		SDP:          msg.SDP,
+		Capabilities: msg.Capabilities,
 	})
 }
 
 func forwardAnswer(client *Client, msg Message) {
-	mutex.Lock()
-	peerClient, exists := clients[msg.PeerToken]
-	mutex.Unlock()
+	if relayToRemote(client, msg) {
+		return
+	}
 
-	if !exists {
-		client.conn.WriteJSON(Message{
-			Type: "error",
-			SDP:  "Peer not found",
-		})
+	peerClient, ok := pairedPeer(client, msg.PeerToken)
+	if !ok {
 		return
 	}
 
 	// Forward the answer to the peer
-	peerClient.conn.WriteJSON(Message{
-		Type:  "answer",
-		Token: client.token,
-		SDP:   msg.SDP,
+	forward(peerClient, Message{
+		Type:         "answer",
+		Token:        client.token,
+		SDP:          msg.SDP,
+		Capabilities: msg.Capabilities,
 	})
 }
 
 func forwardICE(client *Client, msg Message) {
-	mutex.Lock()
-	peerClient, exists := clients[msg.PeerToken]
-	mutex.Unlock()
+	if relayToRemote(client, msg) {
+		return
+	}
 
-	if !exists {
-		client.conn.WriteJSON(Message{
-			Type: "error",
-			SDP:  "Peer not found",
-		})
+	peerClient, ok := pairedPeer(client, msg.PeerToken)
+	if !ok {
 		return
 	}
 
 	// Forward the ICE candidate to the peer
-	peerClient.conn.WriteJSON(Message{
+	forward(peerClient, Message{
 		Type:  "ice",
 		Token: client.token,
 		ICE:   msg.ICE,
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metrics holds the counters exposed on /metrics
+type Metrics struct {
+	mu        sync.Mutex
+	received  map[string]uint64 // Messages read from clients, by type
+	forwarded map[string]uint64 // Messages relayed to a peer, by type
+	wsErrors  map[string]uint64 // WebSocket errors, by stage (upgrade, read, write)
+}
+
+// knownMessageTypes bounds the label values a client can create
+var knownMessageTypes = map[string]bool{
+	"ping":           true,
+	"connect":        true,
+	"accept":         true,
+	"reject":         true,
+	"ice":            true,
+	"offer":          true,
+	"answer":         true,
+	"session-report": true,
+}
+
+var metrics = &Metrics{
+	received:  make(map[string]uint64),
+	forwarded: make(map[string]uint64),
+	wsErrors:  make(map[string]uint64),
+}
+
+func (m *Metrics) countReceived(msgType string) {
+	if !knownMessageTypes[msgType] {
+		msgType = "other"
+	}
+
+	m.mu.Lock()
+	m.received[msgType]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countForwarded(msgType string) {
+	m.mu.Lock()
+	m.forwarded[msgType]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) countError(stage string) {
+	m.mu.Lock()
+	m.wsErrors[stage]++
+	m.mu.Unlock()
+}
+
+// forward relays a message to a peer and counts it if it was delivered or queued
+func forward(peer *Client, msg Message) error {
+	err := peer.send(msg)
+	if err == nil {
+		metrics.countForwarded(msg.Type)
+	}
+	return err
+}
+
+// handleMetrics serves the counters in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	connected, reconnecting := 0, 0
+	for _, client := range clients {
+		if client.conn != nil {
+			connected++
+		} else {
+			reconnecting++
+		}
+	}
+	activePairings := len(pairings)
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintln(w, "# HELP p2pftp_clients Registered signaling clients.")
+	fmt.Fprintln(w, "# TYPE p2pftp_clients gauge")
+	fmt.Fprintf(w, "p2pftp_clients{state=\"connected\"} %d\n", connected)
+	fmt.Fprintf(w, "p2pftp_clients{state=\"reconnecting\"} %d\n", reconnecting)
+
+	fmt.Fprintln(w, "# HELP p2pftp_pairings Accepted peer pairings.")
+	fmt.Fprintln(w, "# TYPE p2pftp_pairings gauge")
+	fmt.Fprintf(w, "p2pftp_pairings %d\n", activePairings)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	writeCounter(w, "p2pftp_messages_received_total", "Signaling messages received from clients.", "type", metrics.received)
+	writeCounter(w, "p2pftp_messages_forwarded_total", "Signaling messages relayed to a peer.", "type", metrics.forwarded)
+	writeCounter(w, "p2pftp_websocket_errors_total", "WebSocket errors.", "stage", metrics.wsErrors)
+}
+
+// writeCounter writes a labelled counter family in a stable order
+func writeCounter(w http.ResponseWriter, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
@@ -3,6 +3,15 @@
  * This file handles the file transfer protocol
  */
 
+// Chunk frame flags, carried in the last header byte when compression is negotiated
+const CHUNK_FLAG_COMPRESSED = 0x01;
+
+// Most sequences one chunk-request may carry, matching the receiver-side validation
+const MAX_CHUNK_REQUEST = 1024;
+
+// Rounds of re-requesting missing chunks after file-complete before verifying anyway
+const MAX_GAP_REQUESTS = 3;
+
 class FileTransfer {
     constructor(p2pConnection, logger) {
         this.p2p = p2pConnection;
@@ -53,7 +62,54 @@ class FileTransfer {
         // CRITICAL FIX: Reduced buffer threshold from 2MB to 512KB for better flow control
         // This triggers buffer management earlier and prevents saturation
         this.bufferThreshold = this.p2p.DATA_BUFFER_SIZE || (512 * 1024); // Use configured data buffer size, reduced to 512KB for better flow control
+        this.bufferLowThreshold = this.bufferThreshold * 0.75; // Resume sending once bufferedAmount drains to this
         this.sendPaused = false;
+        this.peerUnreachable = false; // Sending is held while the peer's heartbeats are missing
+        this.readAheadChunks = 8; // Chunks read from disk ahead of the send position
+        this.compressionRatioThreshold = 0.9; // Send compressed only if it saves at least 10%
+        this.compressionProbeChunks = 4; // Give up on a file after this many chunks that don't compress
+        
+        // Per-transfer summaries, exportable as a JSONL log
+        this.transferSummaries = [];
+        this.maxTransferSummaries = 200;
+        
+        // Slow consumer detection
+        this.ackLagThreshold = 2000; // ms without ack progress before the receiver is considered slow
+        this.controlBacklogThreshold = 64 * 1024; // Outbound control channel backlog warning level
+        this.lastControlBacklogWarning = 0;
+        this.maxDelayedAckChunks = 16; // Ack immediately after this many chunks even within the delay
+        
+        // Transfer watchdog
+        this.maxTransferDuration = 0; // ms, 0 = unlimited
+        this.stallTimeout = 60000; // Abort a transfer that makes no progress for this long
+        this.watchdogInterval = 5000;
+        this.watchdogTimer = null;
+        
+        // Bandwidth throttling (token bucket shared by all outgoing transfers)
+        this.rateLimit = 0; // Bytes per second, 0 = unlimited
+        this.rateTokens = 0;
+        this.lastRateRefill = 0;
+        
+        // Incoming file filters, checked against file-info before accepting
+        this.blockedExtensions = []; // Lowercase, without the leading dot
+        this.blockedHashes = new Set(); // Lowercase MD5 hex digests
+        
+        // Incoming files are assembled in memory, so bound what a peer can make us allocate
+        this.maxReceiveMemory = 512 * 1024 * 1024; // Bytes buffered across all incoming files, see setReceiveMemoryLimit()
+        
+        // Incoming file offers
+        this.autoAcceptFiles = false; // Accept every offer without asking
+        // Scoped to the current peer session; cleared by resetOffers()
+        this.acceptedOffers = new Set(); // Sender transfer IDs we accepted and expect file-info for
+        this.directoryManifests = new Map(); // dirId -> paths announced by the peer's dir-info
+        this.acceptedDirectories = new Set(); // dirIds whose remaining announced files are accepted
+        
+        // Send queue: waiting files start by priority and start time, and a
+        // higher-priority file holds lower-priority ones until it finishes
+        this.sendQueue = []; // Entries waiting to start
+        this.queuedSends = []; // Entries started from the queue and not finished
+        this.nextQueueId = 1;
+        this.sendQueueTimer = null;
         
         // Speed calculation tracking
         this.lastSpeedCalculationTime = 0;
@@ -67,6 +123,12 @@ class FileTransfer {
         this.onVerificationStart = null;
         this.onVerificationComplete = null;
         this.onVerificationFailed = null;
+        this.onDirectoryInfo = null;
+        this.onFileOffer = null; // (info) => boolean or Promise<boolean>
+        this.onQueueChange = null; // (entries) when the send queue changes
+        this.onHashProgress = null; // Hashing progress before sending and while verifying
+        this.onTransferSummary = null; // Structured summary once a transfer finishes
+        this.onReceiverReport = null; // (summary, report) once the receiver reports on a file we sent
         
         // Set up control message handler
         this.p2p.onControlMessage = (message) => {
@@ -82,6 +144,550 @@ class FileTransfer {
         this.logger.log('DEBUG: FileTransfer callbacks set up. p2p object:', this.p2p ? 'exists' : 'null');
     }
 
+    /**
+     * Cap outgoing throughput across all transfers
+     * @param {number} bytesPerSecond - The rate limit, 0 for unlimited
+     */
+    setRateLimit(bytesPerSecond) {
+        this.rateLimit = Math.max(0, Math.floor(bytesPerSecond) || 0);
+        this.rateTokens = 0;
+        this.lastRateRefill = Date.now();
+        
+        if (this.rateLimit > 0) {
+            this.logger.log(`Rate limit set to ${this.rateLimit} bytes/s`);
+        } else {
+            this.logger.log('Rate limit disabled');
+        }
+    }
+
+    /**
+     * Record a transfer's outcome once: in the local summary log and,
+     * if the server keeps history, with the signaling server
+     * @param {Object} transferData - The transfer data
+     * @param {boolean} success - Whether the file arrived intact
+     * @private
+     */
+    _recordTransferOutcome(transferData, success) {
+        if (transferData.sessionReported) {
+            return;
+        }
+        transferData.sessionReported = true;
+        
+        const receiving = Boolean(transferData.remoteTransferId);
+        const bytes = (receiving ? transferData.bytesReceived : transferData.bytesSent) || 0;
+        const duration = Date.now() - transferData.startTime;
+        
+        this.p2p.reportSession({
+            direction: receiving ? 'receive' : 'send',
+            bytes: bytes,
+            duration: duration,
+            success: success
+        });
+        
+        const summary = {
+            time: new Date().toISOString(),
+            direction: receiving ? 'receive' : 'send',
+            name: transferData.file.path || transferData.file.name,
+            size: transferData.file.size,
+            md5: (receiving ? transferData.file.md5 : transferData.md5) || null,
+            success: success,
+            bytes: bytes,
+            duration: duration,
+            averageSpeed: duration > 0 ? Math.round(bytes / (duration / 1000)) : 0,
+            peakSpeed: Math.round(transferData.peakSpeed || 0),
+            retransmittedChunks: transferData.retransmittedChunks || 0
+        };
+        if (!receiving && transferData.minWindowSeen !== undefined) {
+            summary.window = {
+                min: transferData.minWindowSeen,
+                max: transferData.maxWindowSeen,
+                final: transferData.windowSize
+            };
+        }
+        if (receiving) {
+            summary.duplicateChunks = transferData.duplicateChunks || 0;
+            summary.requestedChunks = transferData.requestedChunks || 0;
+        } else if (transferData.receiverReport) {
+            summary.receiverReport = transferData.receiverReport;
+        }
+        transferData.summary = summary;
+        
+        this.transferSummaries.push(summary);
+        if (this.transferSummaries.length > this.maxTransferSummaries) {
+            this.transferSummaries.shift();
+        }
+        this.logger.log('Transfer summary:', JSON.stringify(summary));
+        
+        if (this.onTransferSummary) {
+            this.onTransferSummary(summary);
+        }
+    }
+    
+    /**
+     * Tell the sender what we saw of a transfer, once it is verified, so both
+     * sides log the same outcome
+     * @param {Object} transferData - The transfer data
+     * @param {string} msgTransferId - The sender's transfer ID
+     * @param {string} md5Hash - The hash of what we received
+     * @private
+     */
+    _sendTransferReport(transferData, msgTransferId, md5Hash) {
+        if (!this.p2p.peerSupports('transferReport')) {
+            return;
+        }
+        
+        this.p2p.sendControlMessage({
+            type: 'transfer-report',
+            transferId: msgTransferId,
+            bytes: transferData.bytesReceived || 0,
+            duplicateChunks: transferData.duplicateChunks || 0,
+            requestedChunks: transferData.requestedChunks || 0,
+            duration: Date.now() - transferData.startTime,
+            md5: md5Hash
+        });
+    }
+    
+    /**
+     * Attach the receiver's report to a file we sent
+     * @param {Object} message - The transfer-report message
+     * @private
+     */
+    _handleTransferReportForTransfer(message) {
+        const transferData = this.activeTransfers.get(message.transferId);
+        if (!transferData || transferData.receiving) {
+            this.logger.warn(`Received transfer report for unknown transfer: ${message.transferId}`);
+            return;
+        }
+        
+        const report = {
+            bytes: message.bytes,
+            duplicateChunks: message.duplicateChunks,
+            requestedChunks: message.requestedChunks,
+            duration: message.duration,
+            md5: message.md5 || null,
+            hashMatches: Boolean(message.md5) && message.md5 === transferData.md5
+        };
+        transferData.receiverReport = report;
+        this.logger.log(`Receiver report for ${transferData.file.name}:`, JSON.stringify(report));
+        if (!report.hashMatches) {
+            this.logger.warn(`Receiver's hash for ${transferData.file.name} differs from ours (${transferData.md5})`);
+        }
+        
+        // The report usually arrives just after file-verified has recorded the summary
+        if (transferData.summary) {
+            transferData.summary.receiverReport = report;
+            if (this.onReceiverReport) {
+                this.onReceiverReport(transferData.summary, report);
+            }
+        }
+    }
+    
+    /**
+     * Update a transfer's peak speed and window range, sampled about once a second
+     * @param {Object} transferData - The transfer data
+     * @param {number} bytes - Bytes moved so far
+     * @private
+     */
+    _sampleTransferStats(transferData, bytes) {
+        const now = Date.now();
+        if (!transferData.statsSampleTime) {
+            transferData.statsSampleTime = transferData.startTime;
+            transferData.statsSampleBytes = 0;
+        }
+        
+        if (transferData.windowSize !== undefined) {
+            transferData.minWindowSeen = Math.min(transferData.minWindowSeen ?? Infinity, transferData.windowSize);
+            transferData.maxWindowSeen = Math.max(transferData.maxWindowSeen ?? 0, transferData.windowSize);
+        }
+        
+        const elapsed = now - transferData.statsSampleTime;
+        if (elapsed < 1000) {
+            return;
+        }
+        const speed = (bytes - transferData.statsSampleBytes) / (elapsed / 1000);
+        transferData.peakSpeed = Math.max(transferData.peakSpeed || 0, speed);
+        transferData.statsSampleTime = now;
+        transferData.statsSampleBytes = bytes;
+    }
+    
+    /**
+     * Export the recorded transfer summaries as JSON Lines
+     * @returns {string} - One JSON object per line
+     */
+    getTransferLog() {
+        return this.transferSummaries.map(summary => JSON.stringify(summary)).join('\n') + (this.transferSummaries.length ? '\n' : '');
+    }
+    
+    /**
+     * Set the maximum time a transfer may take before it is aborted
+     * @param {number} ms - The limit in milliseconds, 0 for unlimited
+     */
+    setMaxTransferDuration(ms) {
+        this.maxTransferDuration = Math.max(0, ms || 0);
+        this.logger.log(this.maxTransferDuration > 0
+            ? `Maximum transfer duration set to ${Math.round(this.maxTransferDuration / 1000)}s`
+            : 'Maximum transfer duration disabled');
+    }
+
+    /**
+     * Set how many bytes incoming files may buffer in memory at once. A single
+     * file larger than this is refused outright.
+     * @param {number} bytes - The limit in bytes
+     */
+    setReceiveMemoryLimit(bytes) {
+        this.maxReceiveMemory = Math.max(1024 * 1024, Math.floor(bytes) || 0);
+        this.logger.log(`Receive memory limit set to ${this.maxReceiveMemory} bytes`);
+    }
+
+    /**
+     * Start the watchdog that aborts stalled or overlong transfers
+     * @private
+     */
+    _startWatchdog() {
+        if (this.watchdogTimer) {
+            return;
+        }
+        this.watchdogTimer = setInterval(() => this._checkTransferWatchdog(), this.watchdogInterval);
+    }
+
+    /**
+     * Abort transfers that exceeded the time limit or stopped making progress
+     * @private
+     */
+    _checkTransferWatchdog() {
+        const now = Date.now();
+        let watching = 0;
+        
+        for (const [transferId, transferData] of this.activeTransfers) {
+            if (transferData.transferComplete || transferData.transferCancelled ||
+                (!transferData.sending && !transferData.receiving)) {
+                continue;
+            }
+            watching++;
+            
+            const elapsed = now - transferData.startTime;
+            if (this.maxTransferDuration > 0 && elapsed > this.maxTransferDuration) {
+                this._abortTransfer(transferId, transferData,
+                    `exceeded the maximum duration of ${Math.round(this.maxTransferDuration / 1000)}s`);
+                continue;
+            }
+            
+            // Only the streaming phase can stall; hashing and verification are local work,
+            // and transfers held for a higher-priority file are idle on purpose
+            let idle = 0;
+            if (transferData.sending && transferData.sendLoopPromise && !this._isHeld(transferData)) {
+                idle = now - transferData.lastAckTime;
+            } else if (transferData.receiving && transferData.receivedChunks < transferData.totalChunks &&
+                !transferData.pausedByPeer) {
+                idle = now - transferData.lastChunkTime;
+            }
+            
+            if (idle > this.stallTimeout) {
+                this._abortTransfer(transferId, transferData, `no progress for ${Math.round(idle / 1000)}s`);
+            }
+        }
+        
+        if (watching === 0) {
+            clearInterval(this.watchdogTimer);
+            this.watchdogTimer = null;
+        }
+    }
+
+    /**
+     * Abort a transfer on a timeout and tell the peer
+     * @param {string} transferId - The local transfer ID
+     * @param {Object} transferData - The transfer data
+     * @param {string} reason - Why the transfer was aborted
+     * @private
+     */
+    _abortTransfer(transferId, transferData, reason) {
+        this.logger.error(`Aborting transfer ${transferId}: ${reason}`);
+        
+        transferData.transferCancelled = true;
+        transferData.sending = false;
+        transferData.receiving = false;
+        transferData.fileData = null;
+        if (transferData.ackTimer) {
+            clearTimeout(transferData.ackTimer);
+            transferData.ackTimer = null;
+        }
+        
+        if (this.p2p.controlChannel && this.p2p.controlChannel.readyState === 'open') {
+            this._sendCancellationForTransfer(transferId);
+        }
+        
+        this._recordTransferOutcome(transferData, false);
+        
+        // Report before removing so the UI can find the transfer's progress entry
+        if (this.onError) {
+            this.onError(new Error(`Transfer of ${transferData.file.name} timed out: ${reason}`));
+        }
+        this.activeTransfers.delete(transferId);
+    }
+
+    /**
+     * Configure which incoming files are refused
+     * @param {Object} blocklist - The blocklist
+     * @param {string[]} blocklist.extensions - Extensions to refuse (e.g. ['exe', '.bat'])
+     * @param {string[]} blocklist.hashes - MD5 hashes to refuse
+     */
+    setBlocklist({ extensions = [], hashes = [] } = {}) {
+        this.blockedExtensions = extensions
+            .map(ext => ext.trim().toLowerCase().replace(/^\./, ''))
+            .filter(ext => ext.length > 0);
+        this.blockedHashes = new Set(hashes
+            .map(hash => hash.trim().toLowerCase())
+            .filter(hash => hash.length > 0));
+        
+        this.logger.log(`Blocklist updated: ${this.blockedExtensions.length} extensions, ${this.blockedHashes.size} hashes`);
+    }
+
+    /**
+     * Declare the filename encoding and add a percent-encoded copy of the names
+     * Peers whose JSON layer mangles non-ASCII text can recover the original
+     * name from the ASCII-only copy.
+     * @param {Object} fileInfo - The outgoing file info (modified in place)
+     * @private
+     */
+    _encodeFileInfoNames(fileInfo) {
+        fileInfo.nameEncoding = 'utf-8';
+        fileInfo.nameEncoded = encodeURIComponent(fileInfo.name);
+        if (fileInfo.path) {
+            fileInfo.pathEncoded = encodeURIComponent(fileInfo.path);
+        }
+    }
+
+    /**
+     * Recover UTF-8 names from an incoming file info
+     * Prefers the percent-encoded copy when present and falls back to the
+     * plain fields for peers that don't send one. Names are NFC-normalized so
+     * decomposed (e.g. macOS) and composed names compare equal.
+     * @param {Object} info - The incoming file info
+     * @returns {Object} - The same info with name and path decoded
+     * @private
+     */
+    _decodeFileInfoNames(info) {
+        const decode = (encoded, plain) => {
+            if (typeof encoded === 'string') {
+                try {
+                    return decodeURIComponent(encoded).normalize('NFC');
+                } catch (error) {
+                    this.logger.warn('Invalid percent-encoded filename, using plain name:', encoded);
+                }
+            }
+            return typeof plain === 'string' ? plain.normalize('NFC') : plain;
+        };
+        
+        info.name = this._sanitizeFileName(decode(info.nameEncoded, info.name));
+        if (info.path || info.pathEncoded) {
+            info.path = this._sanitizePath(decode(info.pathEncoded, info.path));
+        }
+        return info;
+    }
+
+    /**
+     * Reduce a name from the peer to a single safe path component
+     * Directories, control characters and "." / ".." are stripped so a
+     * malicious sender can't steer where the file is saved.
+     * @param {string} name - The name as sent
+     * @returns {string} - A name that is safe to save under
+     * @private
+     */
+    _sanitizeFileName(name) {
+        const parts = String(name || '').split(/[\/\\]/);
+        let base = parts[parts.length - 1].replace(/[\x00-\x1f\x7f]/g, '').trim();
+        if (base === '' || base === '.' || base === '..') {
+            base = 'download';
+        }
+        if (name && base !== name) {
+            this.logger.warn('Sanitized incoming file name:', JSON.stringify(name));
+        }
+        return base;
+    }
+
+    /**
+     * Clean a relative path from a directory transfer
+     * Absolute prefixes, backslashes, control characters and "." / ".."
+     * components are removed, so the path always stays inside its folder.
+     * @param {string} path - The path as sent
+     * @returns {string|null} - The cleaned path, or null if nothing is left
+     * @private
+     */
+    _sanitizePath(path) {
+        const parts = String(path || '').split(/[\/\\]/)
+            .map(part => part.replace(/[\x00-\x1f\x7f]/g, '').trim())
+            .filter(part => part !== '' && part !== '.' && part !== '..');
+        const cleaned = parts.join('/');
+        if (path && cleaned !== path) {
+            this.logger.warn('Sanitized incoming file path:', JSON.stringify(path));
+        }
+        return cleaned || null;
+    }
+
+    /**
+     * Check an incoming file against the blocklist
+     * @param {Object} info - The file info from the sender
+     * @returns {Object|null} - A rejection with code and reason, or null if allowed
+     * @private
+     */
+    _checkBlocklist(info) {
+        const name = (info.path || info.name || '').toLowerCase();
+        const dot = name.lastIndexOf('.');
+        const extension = dot >= 0 ? name.slice(dot + 1) : '';
+        
+        if (extension && this.blockedExtensions.includes(extension)) {
+            return { code: 'blocked-extension', reason: `Files with extension .${extension} are not accepted` };
+        }
+        
+        if (info.md5 && this.blockedHashes.has(info.md5.toLowerCase())) {
+            return { code: 'blocked-hash', reason: 'File hash is on the receiver\'s blocklist' };
+        }
+        
+        return null;
+    }
+
+    /**
+     * Check that an incoming file fits the memory we're willing to set aside
+     * @param {Object} info - The file info from the sender
+     * @returns {Object|null} - A rejection with code and reason, or null if it fits
+     * @private
+     */
+    _checkReceiveLimits(info) {
+        // The chunk map is sized from the size and the negotiated chunk size,
+        // so both must be sane before either is allocated
+        const chunkSize = this.p2p.negotiatedChunkSize;
+        if (!Number.isInteger(chunkSize) || chunkSize < this.p2p.MIN_CHUNK_SIZE || chunkSize > this.p2p.MAX_CHUNK_SIZE) {
+            return { code: 'too-large', reason: `Negotiated chunk size ${chunkSize} is out of range` };
+        }
+        if (info.size > this.maxReceiveMemory) {
+            return {
+                code: 'too-large',
+                reason: `File is ${info.size} bytes, the receiver buffers at most ${this.maxReceiveMemory}`
+            };
+        }
+        const totalChunks = Math.ceil(info.size / chunkSize);
+        if (!Number.isSafeInteger(info.size) || totalChunks > Math.ceil(this.maxReceiveMemory / chunkSize)) {
+            return { code: 'too-large', reason: `File of ${info.size} bytes needs ${totalChunks} chunks, more than the receiver buffers` };
+        }
+        
+        let reserved = 0;
+        for (const transferData of this.activeTransfers.values()) {
+            if (transferData.receiving && !transferData.transferComplete && !transferData.transferCancelled) {
+                reserved += transferData.totalBytes;
+            }
+        }
+        if (reserved + info.size > this.maxReceiveMemory) {
+            return {
+                code: 'too-large',
+                reason: 'Receiver is out of memory for incoming files, try again when current transfers finish'
+            };
+        }
+        return null;
+    }
+
+    /**
+     * Wait until the token bucket allows sending the given number of bytes
+     * @param {number} bytes - The payload size about to be sent
+     * @returns {Promise} - Resolves when the bytes may be sent
+     * @private
+     */
+    async _waitForRateLimit(bytes) {
+        while (this.rateLimit > 0) {
+            const now = Date.now();
+            // Allow at most one second of burst, but always enough for a single chunk
+            const bucketSize = Math.max(this.rateLimit, bytes);
+            this.rateTokens = Math.min(bucketSize, this.rateTokens + (now - this.lastRateRefill) * this.rateLimit / 1000);
+            this.lastRateRefill = now;
+            
+            if (this.rateTokens >= bytes) {
+                this.rateTokens -= bytes;
+                return;
+            }
+            
+            // Sleep until enough tokens accumulate (re-checked in case the limit changes)
+            const waitMs = Math.ceil((bytes - this.rateTokens) * 1000 / this.rateLimit);
+            await new Promise(resolve => setTimeout(resolve, Math.min(waitMs, 1000)));
+        }
+    }
+
+    /**
+     * Report flow-control state for each active transfer
+     * @returns {Object[]} - Per-transfer window, in-flight, retransmit and missing-chunk counts
+     */
+    getTransferStats() {
+        const stats = [];
+        for (const transferData of this.activeTransfers.values()) {
+            if (transferData.transferComplete || transferData.transferCancelled) {
+                continue;
+            }
+            
+            const entry = {
+                id: transferData.id,
+                name: transferData.file.path || transferData.file.name,
+                direction: transferData.sending ? 'send' : 'receive'
+            };
+            if (transferData.sending) {
+                entry.windowSize = transferData.windowSize;
+                entry.inFlightChunks = transferData.inFlightChunks;
+                entry.retransmittedChunks = transferData.retransmittedChunks;
+                entry.paused = transferData.sendPaused;
+            } else {
+                // Gaps below the highest chunk seen are what we'd ask to be resent
+                let missing = 0;
+                for (let i = 0; i < transferData.highestSequence; i++) {
+                    if (!transferData.chunks[i]) {
+                        missing++;
+                    }
+                }
+                entry.missingChunks = missing;
+                entry.unackedChunks = transferData.unackedChunks;
+            }
+            stats.push(entry);
+        }
+        return stats;
+    }
+
+    /**
+     * Hold or release sending while the peer's heartbeats are missing
+     * @param {boolean} reachable - Whether the peer is answering
+     */
+    setPeerReachable(reachable) {
+        if (reachable !== this.peerUnreachable) {
+            return;
+        }
+        this.peerUnreachable = !reachable;
+        
+        if (reachable) {
+            this.logger.log('Peer reachable again, resuming transfers');
+            this.resumeAfterSleep();
+        } else if (this.activeTransfers.size > 0) {
+            this.logger.warn('Peer unreachable, pausing transfers');
+        }
+    }
+
+    /**
+     * Nudge active transfers after the machine resumes from sleep
+     * Re-sends our acknowledgments so a sender waiting on a full window
+     * continues, and resets ack timers so the gap isn't mistaken for a slow peer
+     */
+    resumeAfterSleep() {
+        const now = Date.now();
+        
+        for (const [transferId, transferData] of this.activeTransfers) {
+            if (transferData.transferComplete || transferData.transferCancelled) {
+                continue;
+            }
+            
+            if (transferData.receiving) {
+                this.logger.log(`Resuming reception of ${transferId} at sequence ${transferData.highestSequence}`);
+                this._sendFlowControlAckForTransfer(transferId, transferData);
+            } else {
+                this.logger.log(`Resuming sending of ${transferId}`);
+                transferData.lastAckTime = now;
+            }
+        }
+    }
+
     /**
      * Extract numeric ID from transfer ID string
      * @param {string} transferId - The transfer ID string (e.g., "send-1" or "recv-send-1")
@@ -103,12 +709,189 @@ class FileTransfer {
         return 0;
     }
 
+    /**
+     * Send a directory tree to the peer, one file at a time
+     * @param {FileList|File[]} files - Files selected from a directory (with webkitRelativePath)
+     * @returns {Promise} - Resolves when all files are sent
+     */
+    async sendDirectory(files) {
+        if (!this.p2p.isConnected()) {
+            throw new Error('Not connected to peer');
+        }
+        
+        const fileList = Array.from(files);
+        if (fileList.length === 0) {
+            throw new Error('Directory is empty');
+        }
+        
+        const entries = fileList.map(file => ({
+            path: file.webkitRelativePath || file.name,
+            size: file.size
+        }));
+        const rootName = entries[0].path.split('/')[0];
+        const dirId = `dir-${this.nextTransferId}`;
+        
+        // Send the manifest so the receiver knows what to expect
+        const manifest = {
+            type: 'dir-info',
+            dirId: dirId,
+            name: rootName,
+            totalSize: entries.reduce((sum, entry) => sum + entry.size, 0),
+            files: entries
+        };
+        
+        this.p2p.sendControlMessage(manifest);
+        this.logger.log(`Sent directory manifest for ${rootName}: ${entries.length} files`);
+        
+        // Transfer each file sequentially
+        for (let i = 0; i < fileList.length; i++) {
+            this.logger.log(`Sending file ${i + 1}/${fileList.length} of ${rootName}: ${entries[i].path}`);
+            await this.sendFile(fileList[i], entries[i].path, null, dirId);
+        }
+        
+        this.logger.log(`Directory ${rootName} sent`);
+    }
+
+    /**
+     * Add a file to the send queue. Due files start highest priority first;
+     * one that outranks the file being sent holds it until it finishes.
+     * @param {File} file - The file to send
+     * @param {Object} [options]
+     * @param {number} [options.priority=0] - Higher numbers go first
+     * @param {number} [options.startAt] - Don't start before this time (ms since the epoch)
+     * @returns {Promise} - Resolves when the file is sent
+     */
+    enqueueFile(file, { priority = 0, startAt = null } = {}) {
+        return new Promise((resolve, reject) => {
+            const entry = {
+                id: `queue-${this.nextQueueId++}`,
+                file: file,
+                priority: priority,
+                startAt: startAt,
+                held: false,
+                resolve: resolve,
+                reject: reject
+            };
+            this.sendQueue.push(entry);
+            this.logger.log(`Queued ${file.name} with priority ${priority}` +
+                (startAt ? ` to start at ${new Date(startAt).toLocaleString()}` : ''));
+            this._drainSendQueue();
+        });
+    }
+
+    /**
+     * Take a file that hasn't started yet off the send queue
+     * @param {string} id - The queue entry ID
+     * @returns {boolean} - Whether the entry was waiting and is now removed
+     */
+    removeFromQueue(id) {
+        const index = this.sendQueue.findIndex(entry => entry.id === id);
+        if (index < 0) {
+            return false;
+        }
+        
+        const [entry] = this.sendQueue.splice(index, 1);
+        entry.reject(new Error(`${entry.file.name} removed from the send queue`));
+        this._drainSendQueue();
+        return true;
+    }
+
+    /**
+     * Describe the send queue, started files first
+     * @returns {Object[]} - Entries with id, name, size, priority, startAt and state
+     */
+    getSendQueue() {
+        const describe = (entry, state) => ({
+            id: entry.id,
+            name: entry.file.name,
+            size: entry.file.size,
+            priority: entry.priority,
+            startAt: entry.startAt,
+            state: state
+        });
+        return [
+            ...this.queuedSends.map(entry => describe(entry, entry.held ? 'held' : 'sending')),
+            ...this.sendQueue.map(entry => describe(entry, 'waiting'))
+        ];
+    }
+
+    /**
+     * Whether a queued transfer is being held for a higher-priority one
+     * @param {Object} transferData - The transfer data
+     * @returns {boolean}
+     * @private
+     */
+    _isHeld(transferData) {
+        return Boolean(transferData.queueEntry && transferData.queueEntry.held);
+    }
+
+    /**
+     * Start due files from the queue, hold or resume started ones by
+     * priority, and wake up again for the next start time
+     * @private
+     */
+    _drainSendQueue() {
+        clearTimeout(this.sendQueueTimer);
+        this.sendQueueTimer = null;
+        const now = Date.now();
+        
+        for (;;) {
+            // First of the highest priority among due files
+            const next = this.sendQueue
+                .filter(entry => !entry.startAt || entry.startAt <= now)
+                .reduce((best, entry) => (!best || entry.priority > best.priority) ? entry : best, null);
+            const running = this.queuedSends.filter(entry => !entry.held);
+            if (!next || running.some(entry => entry.priority >= next.priority)) {
+                break;
+            }
+            
+            // Peers that can't be told about holds would time them out, so share the link instead
+            if (this.p2p.peerSupports('transferPause')) {
+                for (const entry of running) {
+                    entry.held = true;
+                    this.logger.log(`Holding ${entry.file.name} for higher-priority ${next.file.name}`);
+                }
+            }
+            
+            this.sendQueue.splice(this.sendQueue.indexOf(next), 1);
+            this.queuedSends.push(next);
+            this.sendFile(next.file, null, next)
+                .then(next.resolve, next.reject)
+                .finally(() => {
+                    this.queuedSends.splice(this.queuedSends.indexOf(next), 1);
+                    this._drainSendQueue();
+                });
+        }
+        
+        // Nothing due outranks what's held, so let the most important held file continue
+        if (!this.queuedSends.some(entry => !entry.held)) {
+            const resume = this.queuedSends
+                .reduce((best, entry) => (!best || entry.priority > best.priority) ? entry : best, null);
+            if (resume) {
+                resume.held = false;
+                this.logger.log(`Resuming ${resume.file.name}`);
+            }
+        }
+        
+        const startTimes = this.sendQueue.filter(entry => entry.startAt > now).map(entry => entry.startAt);
+        if (startTimes.length > 0) {
+            this.sendQueueTimer = setTimeout(() => this._drainSendQueue(), Math.min(...startTimes) - now);
+        }
+        
+        if (this.onQueueChange) {
+            this.onQueueChange(this.getSendQueue());
+        }
+    }
+
     /**
      * Send a file to the peer
      * @param {File} file - The file to send
+     * @param {string} [path] - Relative path of the file when part of a directory transfer
+     * @param {Object} [queueEntry] - The send queue entry that started this transfer
+     * @param {string} [dirId] - The directory transfer this file belongs to
      * @returns {Promise} - Resolves when the file is sent
      */
-    async sendFile(file) {
+    async sendFile(file, path = null, queueEntry = null, dirId = null) {
         if (!this.p2p.isConnected()) {
             throw new Error('Not connected to peer');
         }
@@ -116,6 +899,7 @@ class FileTransfer {
         // Wait for capabilities exchange to complete
         try {
             await this.p2p.waitForCapabilitiesExchange();
+            await this.p2p.waitForEncryption();
         } catch (error) {
             throw new Error('Capabilities exchange failed: ' + error.message);
         }
@@ -150,7 +934,15 @@ class FileTransfer {
             speedHistory: [],
             lastSpeedCalculationTime: 0,
             lastBytesReceived: 0,
-            sendLoopPromise: null
+            lastAckTime: Date.now(),
+            slowConsumer: false,
+            windowBeforeSlowConsumer: null,
+            retransmittedChunks: 0,
+            sendLoopPromise: null,
+            sourceSize: file.size,
+            sourceLastModified: file.lastModified,
+            queueEntry: queueEntry,
+            dirId: dirId
         };
         
         // Store transfer data
@@ -177,16 +969,28 @@ class FileTransfer {
         
         try {
             // Calculate MD5 hash
-            const md5Hash = await this._calculateMD5(file);
+            const md5Hash = await this._calculateMD5(file, this._createHashProgressReporter(transferId, 'hashing', file.name));
+            transferData.md5 = md5Hash;
             
             // Send file info with transfer ID
             this.fileInfo = {
-                name: file.name,
+                name: file.name.normalize('NFC'),
                 size: file.size,
                 md5: md5Hash,
                 transferId: transferId
             };
             
+            if (path) {
+                this.fileInfo.path = path.normalize('NFC');
+            }
+            
+            this._encodeFileInfoNames(this.fileInfo);
+            
+            // Let the receiver decide before we stream anything
+            if (this.p2p.peerFileOffers) {
+                await this._offerFileForTransfer(this.fileInfo, transferData);
+            }
+            
             this._sendFileInfoForTransfer(this.fileInfo, transferId);
             
             // Start sending chunks
@@ -241,8 +1045,14 @@ class FileTransfer {
                     transferData.fileData = null;
                 }
                 
+                // Stop waiting for an answer to our offer
+                if (transferData.offerReject) {
+                    transferData.offerReject(new Error('Transfer cancelled by user'));
+                }
+                
                 // Notify peer about cancellation
                 this._sendCancellationForTransfer(transferId);
+                this._recordTransferOutcome(transferData, false);
                 
                 // Remove from active transfers
                 this.activeTransfers.delete(transferId);
@@ -300,7 +1110,7 @@ class FileTransfer {
             info: fileInfo
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent file info:', fileInfo);
     }
     
@@ -317,7 +1127,7 @@ class FileTransfer {
             info: fileInfo
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent file info for transfer:', transferId, fileInfo);
     }
 
@@ -325,6 +1135,9 @@ class FileTransfer {
         if (!transferData || transferData.sendLoopPromise) {
             return;
         }
+        // Hashing and the offer can take a while; measure ack lag from here
+        transferData.lastAckTime = Date.now();
+        this._startWatchdog();
         transferData.sendLoopPromise = (async () => {
             try {
                 await this._sendChunksForTransfer(transferData);
@@ -344,11 +1157,14 @@ class FileTransfer {
             return;
         }
         
-        const reader = new FileReader();
         let transferSequence = 0;
+        const readAhead = new Map(); // sequence -> pending chunk read
         
         // Process chunks sequentially for this transfer
         while (transferSequence < transferData.totalChunks && !transferData.transferCancelled) {
+            // Keep disk reads running while we wait on the buffer and window
+            this._prefetchChunks(transferData, readAhead, transferSequence);
+            
             // Check if we need to pause sending due to buffer congestion
             const currentBufferedAmount = this.p2p.dataChannel ? this.p2p.dataChannel.bufferedAmount : 0;
             
@@ -357,21 +1173,30 @@ class FileTransfer {
                 transferData.sendPaused = true;
                 this.logger.log(`Buffer congestion for transfer ${transferData.id} - buffered: ${currentBufferedAmount}, threshold: ${this.bufferThreshold}`);
                 
-                // Wait for buffer to clear - use 75% threshold instead of 50% for better flow
-                await new Promise(resolve => {
-                    const checkBuffer = () => {
-                        const newBufferedAmount = this.p2p.dataChannel ? this.p2p.dataChannel.bufferedAmount : 0;
-                        if (newBufferedAmount <= this.bufferThreshold * 0.75) {
-                            transferData.sendPaused = false;
-                            this.logger.log(`Resuming send for transfer ${transferData.id} - buffered: ${newBufferedAmount}`);
-                            resolve();
-                        } else {
-                            setTimeout(checkBuffer, 50); // Check more frequently
-                        }
-                    };
-                    
-                    setTimeout(checkBuffer, 50);
-                });
+                await this._waitForBufferedAmountLow(transferData);
+                transferData.sendPaused = false;
+                this.logger.log(`Resuming send for transfer ${transferData.id} - buffered: ${this.p2p.dataChannel ? this.p2p.dataChannel.bufferedAmount : 0}`);
+            }
+            
+            // Hold chunks while the peer isn't answering heartbeats or a higher-priority file goes first
+            if (this.peerUnreachable || this._isHeld(transferData)) {
+                transferData.sendPaused = true;
+                
+                // Tell the receiver, so its watchdog doesn't take the hold for a stall
+                const held = this._isHeld(transferData);
+                if (held) {
+                    this.p2p.sendControlMessage({ type: 'transfer-paused', transferId: transferData.id });
+                }
+                while ((this.peerUnreachable || this._isHeld(transferData)) && !transferData.transferCancelled) {
+                    await new Promise(resolve => setTimeout(resolve, 250));
+                }
+                if (held && !transferData.transferCancelled) {
+                    this.p2p.sendControlMessage({ type: 'transfer-resumed', transferId: transferData.id });
+                }
+                transferData.lastAckTime = Date.now();
+                
+                transferData.sendPaused = false;
+                continue;
             }
             
             // Check if we need to wait for window space - CRITICAL FIX: No recovery mechanism
@@ -383,6 +1208,8 @@ class FileTransfer {
                     const checkWindow = () => {
                         const elapsed = Date.now() - waitStartTime;
                         
+                        this._checkSlowConsumer(transferData);
+                        
                         if (transferData.inFlightChunks < transferData.windowSize) {
                             resolve();
                         } else if (elapsed > timeoutMs) {
@@ -407,39 +1234,37 @@ class FileTransfer {
             // Calculate chunk boundaries
             const start = transferSequence * transferData.chunkSize;
             const end = Math.min(start + transferData.chunkSize, transferData.file.size);
-            const chunkData = transferData.file.slice(start, end);
-            
-            // Read chunk data
-            const chunkArrayBuffer = await new Promise((resolve, reject) => {
-                reader.onload = (e) => resolve(e.target.result);
-                reader.onerror = (e) => reject(e);
-                reader.readAsArrayBuffer(chunkData);
-            });
-            
-            // Create chunk with header including transfer ID
-            const chunk = new ArrayBuffer(12 + chunkArrayBuffer.byteLength);
-            const view = new DataView(chunk);
-            
-            // Write transfer ID (4 bytes) - CRITICAL FIX for multiple transfers
-            // Use direct string-to-number conversion instead of regex
-            const transferIdNum = this._extractTransferIdNumber(transferData.id);
-            view.setUint32(0, transferIdNum);
             
-            // Write sequence number (4 bytes)
-            view.setUint32(4, transferSequence);
+            // Pace the send if a rate limit is configured
+            await this._waitForRateLimit(end - start);
+            if (transferData.transferCancelled) {
+                break;
+            }
             
-            // Write chunk size (4 bytes)
-            view.setUint32(8, chunkArrayBuffer.byteLength);
+            // Collect the prefetched chunk, giving up if the source file changed underneath us
+            let chunkArrayBuffer;
+            try {
+                chunkArrayBuffer = await readAhead.get(transferSequence);
+            } catch (error) {
+                this._failChangedSource(transferData, error.message);
+                break;
+            }
             
-            // Copy chunk data (skip 12-byte header: 4 bytes transfer ID + 4 bytes sequence + 4 bytes chunk size)
-            new Uint8Array(chunk, 12).set(new Uint8Array(chunkArrayBuffer));
+            // Create chunk with header including transfer ID
+            const chunk = await this._buildChunkFrame(transferData, transferSequence, chunkArrayBuffer);
             
             // Send chunk
             try {
                 this.p2p.dataChannel.send(chunk);
+                // With nothing in flight there was no ack to wait for, so the
+                // ack clock starts with this chunk, not with the offer or a hold
+                if (transferData.inFlightChunks === 0) {
+                    transferData.lastAckTime = Date.now();
+                }
                 transferData.inFlightChunks++;
                 transferData.bytesSent += chunkArrayBuffer.byteLength;
                 transferData.sentChunks++;
+                this._sampleTransferStats(transferData, transferData.bytesSent);
                 
                 // Update legacy state for backward compatibility
                 this.bytesSent = transferData.bytesSent;
@@ -464,6 +1289,7 @@ class FileTransfer {
                     this.onProgress(progress);
                 }
                 
+                readAhead.delete(transferSequence);
                 transferSequence++;
             } catch (error) {
                 this.logger.error(`Error sending chunk for transfer ${transferData.id}:`, error);
@@ -476,10 +1302,395 @@ class FileTransfer {
             }
         }
         
-        // Send file complete message when all chunks are sent
-        if (!transferData.transferCancelled) {
-            this._sendFileCompleteForTransfer(transferData);
+        // Send file complete message when all chunks are sent
+        if (!transferData.transferCancelled) {
+            this._sendFileCompleteForTransfer(transferData);
+        }
+    }
+
+    /**
+     * Get the binary chunk header size for the negotiated protocol
+     * @returns {number} - Header size in bytes
+     * @private
+     */
+    _getChunkHeaderSize() {
+        // 4 bytes transfer ID + 4 bytes sequence + 4 bytes chunk size (+ 4 bytes CRC32 if negotiated)
+        // (+ 1 flags byte if compression was negotiated)
+        return (this.p2p.chunkChecksumsEnabled ? 16 : 12) + (this.p2p.compressionFormat ? 1 : 0);
+    }
+    
+    /**
+     * Build a binary chunk frame for a transfer
+     * @param {Object} transferData - The transfer data
+     * @param {number} sequence - The chunk sequence number
+     * @param {ArrayBuffer} chunkArrayBuffer - The chunk payload
+     * @returns {Promise<ArrayBuffer>} - The framed (and, if negotiated, encrypted) chunk
+     * @private
+     */
+    async _buildChunkFrame(transferData, sequence, chunkArrayBuffer) {
+        const transferIdNum = this._extractTransferIdNumber(transferData.id);
+        
+        // Compress first (encrypted data doesn't compress), keeping it only if it pays off
+        let payload = new Uint8Array(chunkArrayBuffer);
+        let flags = 0;
+        if (this.p2p.compressionFormat && transferData.compress !== false) {
+            const compressed = await this._transformChunk(payload, new CompressionStream(this.p2p.compressionFormat));
+            if (compressed.byteLength < payload.byteLength * this.compressionRatioThreshold) {
+                payload = compressed;
+                flags |= CHUNK_FLAG_COMPRESSED;
+                transferData.compressedChunks = (transferData.compressedChunks || 0) + 1;
+            } else {
+                transferData.incompressibleChunks = (transferData.incompressibleChunks || 0) + 1;
+                // Already-compressed files: stop spending CPU once the first chunks show no gain
+                if (!transferData.compressedChunks && transferData.incompressibleChunks >= this.compressionProbeChunks) {
+                    transferData.compress = false;
+                    this.logger.log(`${transferData.file.name} does not compress, sending uncompressed`);
+                }
+            }
+        }
+        
+        // Encrypt the payload if end-to-end encryption was negotiated
+        if (this.p2p.encryptionEnabled) {
+            payload = new Uint8Array(await this.p2p.encryptChunk(payload, transferIdNum, sequence));
+        }
+        
+        const headerSize = this._getChunkHeaderSize();
+        const chunk = new ArrayBuffer(headerSize + payload.byteLength);
+        const view = new DataView(chunk);
+        
+        // Write transfer ID (4 bytes) - CRITICAL FIX for multiple transfers
+        // Use direct string-to-number conversion instead of regex
+        view.setUint32(0, transferIdNum);
+        
+        // Write sequence number (4 bytes)
+        view.setUint32(4, sequence);
+        
+        // Write chunk size (4 bytes)
+        view.setUint32(8, payload.byteLength);
+        
+        // Write payload checksum (4 bytes) if negotiated
+        if (this.p2p.chunkChecksumsEnabled) {
+            view.setUint32(12, this._crc32(payload));
+        }
+        
+        // Write flags (1 byte) if compression was negotiated
+        if (this.p2p.compressionFormat) {
+            view.setUint8(headerSize - 1, flags);
+        }
+        
+        // Copy chunk data after the header
+        new Uint8Array(chunk, headerSize).set(payload);
+        
+        return chunk;
+    }
+    
+    /**
+     * Run a chunk through a compression or decompression stream
+     * @param {Uint8Array} bytes - The input
+     * @param {CompressionStream|DecompressionStream} stream - The transform
+     * @param {number} [maxBytes=Infinity] - Stop and return null once the output grows past this
+     * @returns {Promise<Uint8Array|null>} - The output, or null if it exceeded maxBytes
+     * @private
+     */
+    async _transformChunk(bytes, stream, maxBytes = Infinity) {
+        // Read the output piece by piece so a decompression bomb is cut off
+        // as soon as it passes the limit instead of being inflated in full
+        const reader = new Blob([bytes]).stream().pipeThrough(stream).getReader();
+        const parts = [];
+        let total = 0;
+        
+        while (true) {
+            const { done, value } = await reader.read();
+            if (done) {
+                break;
+            }
+            total += value.length;
+            if (total > maxBytes) {
+                await reader.cancel();
+                return null;
+            }
+            parts.push(value);
+        }
+        
+        const output = new Uint8Array(total);
+        let offset = 0;
+        for (const part of parts) {
+            output.set(part, offset);
+            offset += part.length;
+        }
+        return output;
+    }
+    
+    /**
+     * Calculate the CRC32 checksum of a byte array
+     * @param {Uint8Array} bytes - The data to checksum
+     * @returns {number} - The unsigned CRC32 value
+     * @private
+     */
+    _crc32(bytes) {
+        if (!this.crcTable) {
+            this.crcTable = new Uint32Array(256);
+            for (let i = 0; i < 256; i++) {
+                let c = i;
+                for (let k = 0; k < 8; k++) {
+                    c = (c & 1) ? (0xEDB88320 ^ (c >>> 1)) : (c >>> 1);
+                }
+                this.crcTable[i] = c >>> 0;
+            }
+        }
+        
+        let crc = 0xFFFFFFFF;
+        for (let i = 0; i < bytes.length; i++) {
+            crc = this.crcTable[(crc ^ bytes[i]) & 0xFF] ^ (crc >>> 8);
+        }
+        return (crc ^ 0xFFFFFFFF) >>> 0;
+    }
+    
+    /**
+     * Ask the sender to retransmit specific chunks
+     * @param {string} transferId - The local transfer ID
+     * @param {Object} transferData - The transfer data
+     * @param {number[]} sequences - The sequences to re-request
+     * @private
+     */
+    _requestChunksForTransfer(transferId, transferData, sequences) {
+        const message = {
+            type: 'chunk-request',
+            transferId: transferData.remoteTransferId || transferId,
+            sequences: sequences
+        };
+        
+        this.p2p.sendControlMessage(message);
+        transferData.requestedChunks = (transferData.requestedChunks || 0) + sequences.length;
+        this.logger.log(`Requested retransmission of ${sequences.length} chunk(s) for transfer ${transferId}:`, sequences.join(','));
+    }
+    
+    /**
+     * Re-request the chunks a finished transfer is still missing, then give
+     * them 5 seconds to arrive. Verification runs once the file is whole or
+     * after MAX_GAP_REQUESTS rounds.
+     * @param {string} transferId - The local transfer ID
+     * @param {Object} transferData - The transfer data
+     * @param {number} round - The request round, starting at 1
+     * @private
+     */
+    _awaitMissingChunks(transferId, transferData, round) {
+        const missing = [];
+        for (let i = 0; i < transferData.totalChunks && missing.length < MAX_CHUNK_REQUEST; i++) {
+            if (!transferData.chunks[i]) {
+                missing.push(i);
+            }
+        }
+        if (missing.length > 0) {
+            this._requestChunksForTransfer(transferId, transferData, missing);
+        }
+        
+        transferData.completionTimeout = setTimeout(() => {
+            if (!transferData.receiving || !transferData.transferComplete) {
+                return;
+            }
+            if (transferData.bytesReceived < transferData.file.size && round < MAX_GAP_REQUESTS) {
+                this._awaitMissingChunks(transferId, transferData, round + 1);
+                return;
+            }
+            this.logger.log(`Completion timeout reached for transfer ${transferId} with ${transferData.bytesReceived}/${transferData.file.size} bytes. Proceeding with verification...`);
+            this._verifyReceivedFileForTransfer(transferId, transferData);
+        }, 5000);
+    }
+    
+    /**
+     * Handle a chunk retransmission request from the receiver
+     * @param {Object} request - The chunk request message
+     * @private
+     */
+    async _handleChunkRequestForTransfer(request) {
+        const transferData = this.activeTransfers.get(request.transferId);
+        if (!transferData || !transferData.sending || transferData.transferCancelled) {
+            this.logger.warn('Received chunk request for unknown or inactive transfer:', request.transferId);
+            return;
+        }
+        
+        if (!Array.isArray(request.sequences)) {
+            this.logger.warn('Received invalid chunk request:', request);
+            return;
+        }
+        
+        for (const sequence of request.sequences) {
+            if (!Number.isInteger(sequence) || sequence < 0 || sequence >= transferData.totalChunks) {
+                this.logger.warn(`Ignoring request for invalid sequence ${sequence} in transfer ${transferData.id}`);
+                continue;
+            }
+            
+            const start = sequence * transferData.chunkSize;
+            const end = Math.min(start + transferData.chunkSize, transferData.file.size);
+            
+            let chunkArrayBuffer;
+            try {
+                chunkArrayBuffer = await this._readSourceChunk(transferData, start, end);
+            } catch (error) {
+                this._failChangedSource(transferData, error.message);
+                return;
+            }
+            
+            try {
+                this.p2p.dataChannel.send(await this._buildChunkFrame(transferData, sequence, chunkArrayBuffer));
+                transferData.retransmittedChunks++;
+                this.logger.log(`Retransmitted chunk ${sequence} for transfer ${transferData.id}`);
+            } catch (error) {
+                this.logger.error(`Error retransmitting chunk ${sequence} for transfer ${transferData.id}:`, error);
+            }
+        }
+    }
+
+    /**
+     * Set the data channel buffer levels at which sending pauses and resumes
+     * @param {number} high - Pause once bufferedAmount exceeds this many bytes
+     * @param {number} low - Resume once bufferedAmount drains to this many bytes
+     */
+    setBufferThresholds(high, low) {
+        if (!(high > 0) || !(low >= 0) || low >= high) {
+            throw new Error('Buffer thresholds must satisfy 0 <= low < high');
+        }
+        this.bufferThreshold = high;
+        this.bufferLowThreshold = low;
+        this.logger.log(`Data channel buffer thresholds set to ${high} (pause) / ${low} (resume) bytes`);
+    }
+    
+    /**
+     * Wait until the data channel drains to the low-water mark
+     * @param {Object} transferData - The transfer data
+     * @returns {Promise} - Resolves on bufferedamountlow, cancellation or channel close
+     * @private
+     */
+    _waitForBufferedAmountLow(transferData) {
+        const channel = this.p2p.dataChannel;
+        if (!channel || channel.bufferedAmount <= this.bufferLowThreshold) {
+            return Promise.resolve();
+        }
+        
+        return new Promise(resolve => {
+            // Cancellation and a closing channel don't fire bufferedamountlow
+            const guard = setInterval(() => {
+                if (transferData.transferCancelled || channel.readyState !== 'open' ||
+                    channel.bufferedAmount <= this.bufferLowThreshold) {
+                    done();
+                }
+            }, 1000);
+            const done = () => {
+                clearInterval(guard);
+                channel.removeEventListener('bufferedamountlow', done);
+                resolve();
+            };
+            
+            channel.bufferedAmountLowThreshold = this.bufferLowThreshold;
+            channel.addEventListener('bufferedamountlow', done);
+        });
+    }
+    
+    /**
+     * Start reads for the chunks following the send position
+     * @param {Object} transferData - The transfer data
+     * @param {Map} readAhead - Pending reads, keyed by sequence
+     * @param {number} fromSequence - The next chunk to send
+     * @private
+     */
+    _prefetchChunks(transferData, readAhead, fromSequence) {
+        const last = Math.min(fromSequence + this.readAheadChunks, transferData.totalChunks);
+        for (let sequence = fromSequence; sequence < last; sequence++) {
+            if (readAhead.has(sequence)) {
+                continue;
+            }
+            const start = sequence * transferData.chunkSize;
+            const end = Math.min(start + transferData.chunkSize, transferData.file.size);
+            const read = this._readSourceChunk(transferData, start, end);
+            // Failures surface when the chunk is collected
+            read.catch(() => {});
+            readAhead.set(sequence, read);
+        }
+    }
+    
+    /**
+     * Read a chunk of the source file, detecting changes since the send began
+     * @param {Object} transferData - The transfer data
+     * @param {number} start - Start offset
+     * @param {number} end - End offset
+     * @returns {Promise<ArrayBuffer>} - The chunk data
+     * @private
+     */
+    async _readSourceChunk(transferData, start, end) {
+        const file = transferData.file;
+        if (file.size !== transferData.sourceSize || file.lastModified !== transferData.sourceLastModified) {
+            throw new Error(`${file.name} was modified during the transfer`);
+        }
+        
+        try {
+            return await file.slice(start, end).arrayBuffer();
+        } catch (error) {
+            // Browsers raise NotReadableError once the file on disk changes or disappears
+            this.logger.error(`Error reading ${file.name} at offset ${start}:`, error);
+            throw new Error(`${file.name} was modified or became unreadable during the transfer`);
+        }
+    }
+    
+    /**
+     * Abort a send whose source file changed and tell the receiver to discard it
+     * @param {Object} transferData - The transfer data
+     * @param {string} reason - Description of the change
+     * @private
+     */
+    _failChangedSource(transferData, reason) {
+        if (transferData.transferCancelled) {
+            return;
+        }
+        this.logger.error(`Aborting transfer ${transferData.id}: ${reason}`);
+        
+        transferData.transferCancelled = true;
+        transferData.sending = false;
+        
+        if (this.p2p.controlChannel && this.p2p.controlChannel.readyState === 'open') {
+            this.p2p.sendControlMessage({
+                type: 'file-changed',
+                transferId: transferData.id,
+                reason: reason
+            });
+        }
+        this._recordTransferOutcome(transferData, false);
+        
+        if (this.onError) {
+            this.onError(new Error(reason));
+        }
+        this.activeTransfers.delete(transferData.id);
+    }
+    
+    /**
+     * Handle notice that the sender's copy of a file changed mid-transfer
+     * @param {Object} message - The file-changed message
+     * @private
+     */
+    _handleFileChangedForTransfer(message) {
+        const transferId = `recv-${message.transferId}`;
+        const transferData = this.activeTransfers.get(transferId);
+        if (!transferData) {
+            this.logger.warn(`Received file-changed for unknown transfer: ${message.transferId}`);
+            return;
+        }
+        
+        this.logger.error(`Sender aborted transfer ${transferId}: ${message.reason}`);
+        
+        // Discard everything received so far
+        transferData.transferCancelled = true;
+        transferData.receiving = false;
+        transferData.fileData = null;
+        if (transferData.ackTimer) {
+            clearTimeout(transferData.ackTimer);
+            transferData.ackTimer = null;
+        }
+        this._recordTransferOutcome(transferData, false);
+        
+        if (this.onError) {
+            this.onError(new Error(`${transferData.file.name} changed on the sender's side; partial data discarded`));
         }
+        this.activeTransfers.delete(transferId);
     }
 
     /**
@@ -492,7 +1703,7 @@ class FileTransfer {
             transferId: transferData.id
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log(`Sent file complete message for transfer ${transferData.id}`);
         transferData.transferComplete = true;
         
@@ -509,7 +1720,7 @@ class FileTransfer {
             type: 'file-complete'
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent file complete message');
         this.transferComplete = true;
     }
@@ -523,7 +1734,7 @@ class FileTransfer {
             type: 'transfer-cancelled'
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent transfer cancellation message');
     }
     
@@ -540,7 +1751,7 @@ class FileTransfer {
             transferId: msgTransferId
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent transfer cancellation message for transfer:', msgTransferId);
     }
 
@@ -568,7 +1779,7 @@ class FileTransfer {
             highestSequence: this.highestSequence
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('Sent progress update:', message);
     }
     
@@ -581,8 +1792,8 @@ class FileTransfer {
     _sendProgressUpdateForTransfer(transferId, transferData) {
         const now = Date.now();
         
-        // Send transfer-specific flow control acknowledgment (unthrottled)
-        this._sendFlowControlAckForTransfer(transferId, transferData);
+        // Send transfer-specific flow control acknowledgment (coalesced if negotiated)
+        this._scheduleFlowControlAckForTransfer(transferId, transferData);
         
         // Send throttled progress updates only for user feedback
         if (now - transferData.lastProgressUpdate < 1000) {
@@ -601,8 +1812,45 @@ class FileTransfer {
             highestSequence: transferData.highestSequence
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
-        this.logger.log('Sent progress update for transfer:', msgTransferId, message);
+        this.p2p.queueControlMessage(message);
+        this.logger.log('Queued progress update for transfer:', msgTransferId, message);
+    }
+    
+    /**
+     * Acknowledge a received chunk, coalescing acks for the negotiated delay
+     * @param {string} transferId - The local transfer ID
+     * @param {Object} transferData - The transfer data
+     * @private
+     */
+    _scheduleFlowControlAckForTransfer(transferId, transferData) {
+        const ackDelay = this.p2p.negotiatedAckDelay;
+        transferData.unackedChunks = (transferData.unackedChunks || 0) + 1;
+        
+        if (ackDelay <= 0 || transferData.unackedChunks >= this.maxDelayedAckChunks) {
+            this._flushFlowControlAckForTransfer(transferId, transferData);
+            return;
+        }
+        
+        if (!transferData.ackTimer) {
+            transferData.ackTimer = setTimeout(() => {
+                this._flushFlowControlAckForTransfer(transferId, transferData);
+            }, ackDelay);
+        }
+    }
+    
+    /**
+     * Send any pending (delayed) acknowledgment for a transfer now
+     * @param {string} transferId - The local transfer ID
+     * @param {Object} transferData - The transfer data
+     * @private
+     */
+    _flushFlowControlAckForTransfer(transferId, transferData) {
+        if (transferData.ackTimer) {
+            clearTimeout(transferData.ackTimer);
+            transferData.ackTimer = null;
+        }
+        transferData.unackedChunks = 0;
+        this._sendFlowControlAckForTransfer(transferId, transferData);
     }
     
     /**
@@ -631,8 +1879,16 @@ class FileTransfer {
             return;
         }
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
-        this.logger.log('DEBUG: Sent flow control acknowledgment for transfer:', msgTransferId, 'sequence:', transferData.highestSequence);
+        // Warn (throttled) when our acks are queueing up faster than they drain
+        const controlBacklog = this.p2p.controlChannel.bufferedAmount;
+        const now = Date.now();
+        if (controlBacklog > this.controlBacklogThreshold && now - this.lastControlBacklogWarning > 1000) {
+            this.lastControlBacklogWarning = now;
+            this.logger.warn(`Control channel backlog for transfer ${msgTransferId}: ${controlBacklog} bytes queued`);
+        }
+        
+        this.p2p.queueControlMessage(message);
+        this.logger.log('DEBUG: Queued flow control acknowledgment for transfer:', msgTransferId, 'sequence:', transferData.highestSequence);
     }
 
     /**
@@ -660,15 +1916,8 @@ class FileTransfer {
             // We have all data, proceed with verification
             this._verifyReceivedFileForTransfer(localTransferId, transferData);
         } else {
-            this.logger.log(`Received file-complete but only have ${transferData.bytesReceived}/${transferData.file.size} bytes for transfer ${localTransferId}. Waiting for remaining chunks...`);
-            
-            // Set a timeout to handle missing chunks
-            transferData.completionTimeout = setTimeout(() => {
-                if (transferData.receiving && transferData.transferComplete) {
-                    this.logger.log(`Completion timeout reached for transfer ${localTransferId} with ${transferData.bytesReceived}/${transferData.file.size} bytes. Proceeding with verification...`);
-                    this._verifyReceivedFileForTransfer(localTransferId, transferData);
-                }
-            }, 5000); // 5 second timeout
+            this.logger.log(`Received file-complete but only have ${transferData.bytesReceived}/${transferData.file.size} bytes for transfer ${localTransferId}. Requesting missing chunks...`);
+            this._awaitMissingChunks(localTransferId, transferData, 1);
         }
         
         // Update legacy state for backward compatibility
@@ -695,6 +1944,7 @@ class FileTransfer {
         
         // Complete transfer
         transferData.sending = false;
+        this._recordTransferOutcome(transferData, true);
         
         // Update legacy state for backward compatibility
         this.sending = false;
@@ -725,6 +1975,7 @@ class FileTransfer {
         
         // Complete transfer with error
         transferData.sending = false;
+        this._recordTransferOutcome(transferData, false);
         
         // Update legacy state for backward compatibility
         this.sending = false;
@@ -734,6 +1985,178 @@ class FileTransfer {
         }
     }
     
+    /**
+     * Offer a file to the receiver and wait for it to be accepted
+     * @param {Object} fileInfo - The file info
+     * @param {Object} transferData - The transfer data
+     * @returns {Promise} - Resolves on file-accept, rejects if refused or cancelled
+     * @private
+     */
+    _offerFileForTransfer(fileInfo, transferData) {
+        return new Promise((resolve, reject) => {
+            transferData.offerResolve = resolve;
+            transferData.offerReject = reject;
+            
+            const message = {
+                type: 'file-offer',
+                transferId: transferData.id,
+                info: fileInfo
+            };
+            if (transferData.dirId) {
+                message.dirId = transferData.dirId;
+            }
+            
+            this.p2p.sendControlMessage(message);
+            this.logger.log(`Offered ${fileInfo.name} to peer, waiting for acceptance`);
+        }).finally(() => {
+            transferData.offerResolve = null;
+            transferData.offerReject = null;
+        });
+    }
+
+    /**
+     * Handle the receiver accepting one of our file offers
+     * @param {string} transferId - The transfer ID
+     * @private
+     */
+    _handleFileAcceptForTransfer(transferId) {
+        const transferData = this.activeTransfers.get(transferId);
+        if (!transferData || !transferData.offerResolve) {
+            this.logger.warn(`Received file accept for unknown or unoffered transfer: ${transferId}`);
+            return;
+        }
+        
+        this.logger.log(`Peer accepted transfer ${transferId}`);
+        transferData.offerResolve();
+    }
+
+    /**
+     * Forget accepted offers and directories when a peer session starts or ends
+     */
+    resetOffers() {
+        this.acceptedOffers.clear();
+        this.directoryManifests.clear();
+        this.acceptedDirectories.clear();
+    }
+
+    /**
+     * Handle a file offer from the peer
+     * @param {Object} message - The offer with transferId and info
+     * @private
+     */
+    async _handleFileOfferForTransfer(message) {
+        const info = this._decodeFileInfoNames(message.info || {});
+        this.logger.log(`Received file offer for transfer ${message.transferId}: ${info.name} (${info.size} bytes)`);
+        
+        const rejection = this._checkBlocklist(info) || this._checkReceiveLimits(info);
+        if (rejection) {
+            this.logger.warn(`Refusing offered file ${info.name}: ${rejection.reason}`);
+            this._sendFileOfferAnswer(message.transferId, rejection);
+            return;
+        }
+        
+        // Files announced in a directory the user already accepted don't ask again
+        const announced = message.dirId ? this.directoryManifests.get(message.dirId) : null;
+        const inDirectory = Boolean(announced && info.path && announced.has(info.path));
+        if (inDirectory) {
+            info.dirId = message.dirId;
+        }
+        
+        let accepted = this.autoAcceptFiles || (inDirectory && this.acceptedDirectories.has(message.dirId));
+        if (!accepted && this.onFileOffer) {
+            try {
+                accepted = await this.onFileOffer(info);
+            } catch (error) {
+                this.logger.error('Error handling file offer:', error);
+                accepted = false;
+            }
+        } else if (!this.onFileOffer) {
+            accepted = true;
+        }
+        
+        if (accepted) {
+            this.acceptedOffers.add(message.transferId);
+            if (inDirectory) {
+                this.acceptedDirectories.add(message.dirId);
+                // Each announced file is only let through once
+                announced.delete(info.path);
+            }
+        }
+        
+        this._sendFileOfferAnswer(message.transferId, accepted ? null : {
+            code: 'declined',
+            reason: 'Receiver declined the file'
+        });
+    }
+
+    /**
+     * Answer a file offer with file-accept, or file-rejected if a rejection is given
+     * @param {string} transferId - The sender's transfer ID
+     * @param {Object|null} rejection - The rejection code and reason
+     * @private
+     */
+    _sendFileOfferAnswer(transferId, rejection) {
+        const message = rejection ? {
+            type: 'file-rejected',
+            transferId: transferId,
+            code: rejection.code,
+            reason: rejection.reason
+        } : {
+            type: 'file-accept',
+            transferId: transferId
+        };
+        
+        this.p2p.sendControlMessage(message);
+        this.logger.log(`Answered file offer ${transferId}:`, message.type);
+    }
+
+    /**
+     * Handle a structured rejection of one of our files by the receiver
+     * @param {Object} message - The rejection with transferId, code and reason
+     * @private
+     */
+    _handleFileRejectedForTransfer(message) {
+        const transferData = this.activeTransfers.get(message.transferId);
+        if (!transferData) {
+            this.logger.warn(`Received file rejected for unknown transfer: ${message.transferId}`);
+            return;
+        }
+        
+        this.logger.warn(`Peer refused transfer ${message.transferId} (${message.code}): ${message.reason}`);
+        
+        // Stop the send loop
+        transferData.transferCancelled = true;
+        transferData.sending = false;
+        this.sending = false;
+        
+        // A refused offer is reported by sendFile itself
+        if (transferData.offerReject) {
+            transferData.offerReject(new Error(`Peer refused ${transferData.file.name}: ${message.reason}`));
+            return;
+        }
+        
+        if (this.onError) {
+            this.onError(new Error(`Peer refused ${transferData.file.name}: ${message.reason}`));
+        }
+    }
+    
+    /**
+     * Note that the sender is holding a transfer for a higher-priority file
+     * @param {string} transferId - The sender's transfer ID
+     * @param {boolean} paused - Whether the transfer is held or resumed
+     * @private
+     */
+    _handleTransferPausedForTransfer(transferId, paused) {
+        const transferData = this.activeTransfers.get(`recv-${transferId}`);
+        if (!transferData || !transferData.receiving) {
+            return;
+        }
+        
+        transferData.pausedByPeer = paused;
+        transferData.lastChunkTime = Date.now();
+        this.logger.log(`Sender ${paused ? 'paused' : 'resumed'} transfer ${transferData.id}`);
+    }
+
     /**
      * Handle transfer cancelled message for specific transfer
      * @param {string} transferId - The transfer ID
@@ -756,6 +2179,9 @@ class FileTransfer {
             return;
         }
         
+        // Stops the send loop and any window wait it is parked in
+        transferData.transferCancelled = true;
+        
         if (transferData.sending) {
             transferData.sending = false;
         }
@@ -765,6 +2191,11 @@ class FileTransfer {
             transferData.fileData = null;
         }
         
+        if (transferData.ackTimer) {
+            clearTimeout(transferData.ackTimer);
+            transferData.ackTimer = null;
+        }
+        
         if (this.sending) {
             this.sending = false;
         }
@@ -774,9 +2205,18 @@ class FileTransfer {
             this.fileData = null;
         }
         
+        this._recordTransferOutcome(transferData, false);
+        
+        // A cancelled offer is reported by sendFile itself
+        if (transferData.offerReject) {
+            transferData.offerReject(new Error('Transfer cancelled by peer'));
+            return;
+        }
+        
         if (this.onError) {
             this.onError(new Error('Transfer cancelled by peer'));
         }
+        this.activeTransfers.delete(lookupId);
     }
 
     /**
@@ -789,7 +2229,7 @@ class FileTransfer {
             highestSequence: this.highestSequence
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('DEBUG: Sent flow control acknowledgment:', message, 'highestSequence:', this.highestSequence);
     }
     
@@ -804,7 +2244,7 @@ class FileTransfer {
             highestSequence: sequence
         };
         
-        this.p2p.controlChannel.send(JSON.stringify(message));
+        this.p2p.sendControlMessage(message);
         this.logger.log('DEBUG: Sent immediate flow control ack for sequence:', sequence);
     }
 
@@ -871,6 +2311,10 @@ class FileTransfer {
                     this._handleFileCompleteForTransfer(message.transferId);
                     break;
                     
+                case 'chunk-request':
+                    this._handleChunkRequestForTransfer(message);
+                    break;
+                    
                 case 'file-verified':
                     this._handleFileVerifiedForTransfer(message.transferId);
                     break;
@@ -879,10 +2323,35 @@ class FileTransfer {
                     this._handleFileFailedForTransfer(message.transferId, message.reason);
                     break;
                     
+                case 'file-rejected':
+                    this._handleFileRejectedForTransfer(message);
+                    break;
+                    
+                case 'file-offer':
+                    this._handleFileOfferForTransfer(message);
+                    break;
+                    
+                case 'file-accept':
+                    this._handleFileAcceptForTransfer(message.transferId);
+                    break;
+                    
                 case 'transfer-cancelled':
                     this._handleTransferCancelledForTransfer(message.transferId);
                     break;
                     
+                case 'file-changed':
+                    this._handleFileChangedForTransfer(message);
+                    break;
+                    
+                case 'transfer-paused':
+                case 'transfer-resumed':
+                    this._handleTransferPausedForTransfer(message.transferId, message.type === 'transfer-paused');
+                    break;
+                    
+                case 'transfer-report':
+                    this._handleTransferReportForTransfer(message);
+                    break;
+                    
                 default:
                     this.logger.warn('Unknown control message type with transfer ID:', message.type, message);
                     break;
@@ -892,6 +2361,10 @@ class FileTransfer {
         
         // Legacy handlers for messages without transfer IDs
         switch (message.type) {
+            case 'dir-info':
+                this._handleDirectoryInfo(message);
+                break;
+                
             case 'file-info':
                 this._handleFileInfo(message.info);
                 break;
@@ -922,14 +2395,55 @@ class FileTransfer {
         }
     }
 
+    /**
+     * Handle directory manifest from peer
+     * @param {Object} manifest - The directory manifest
+     * @private
+     */
+    _handleDirectoryInfo(manifest) {
+        if (!Array.isArray(manifest.files)) {
+            this.logger.warn('Received invalid directory manifest:', manifest);
+            return;
+        }
+        
+        this.logger.log(`Receiving directory ${manifest.name}: ${manifest.files.length} files (${manifest.totalSize} bytes)`);
+        
+        // Remember the announced paths, cleaned the way offered paths are
+        const paths = new Set();
+        for (const entry of manifest.files) {
+            if (typeof entry.path === 'string') {
+                paths.add(this._sanitizePath(entry.path.normalize('NFC')));
+            }
+        }
+        this.directoryManifests.set(manifest.dirId, paths);
+        
+        if (this.onDirectoryInfo) {
+            this.onDirectoryInfo(manifest);
+        }
+    }
+
     /**
      * Handle file info message from peer
      * @param {Object} info - The file info
      * @private
      */
     _handleFileInfo(info) {
+        info = this._decodeFileInfoNames(info);
         this.logger.log('Received file info:', info);
         
+        // Legacy transfers can't be offered, so we don't take them while asking first
+        if (this.p2p.fileOffers) {
+            this.logger.warn(`Ignoring file info for ${info.name}: it was never offered`);
+            return;
+        }
+        
+        // Legacy transfers have no ID to reject, so just ignore an oversized one
+        const rejection = this._checkReceiveLimits(info);
+        if (rejection) {
+            this.logger.warn(`Ignoring file info for ${info.name}: ${rejection.reason}`);
+            return;
+        }
+        
         // Reset state
         this.fileInfo = info;
         this.fileData = new Uint8Array(info.size);
@@ -962,8 +2476,42 @@ class FileTransfer {
      * @private
      */
     _handleFileInfoForTransfer(info, transferId) {
+        info = this._decodeFileInfoNames(info);
         this.logger.log('Received file info for transfer:', transferId, info);
         
+        // Only files we accepted an offer for may follow; each acceptance is used once
+        let rejection = null;
+        if (this.p2p.fileOffers && !this.acceptedOffers.delete(transferId)) {
+            rejection = { code: 'not-accepted', reason: 'Receiver only takes files it accepted an offer for' };
+        }
+        
+        // Refuse blocked or oversized files before allocating anything for them
+        rejection = rejection || this._checkBlocklist(info) || this._checkReceiveLimits(info);
+        let fileData = null;
+        if (!rejection) {
+            try {
+                fileData = new Uint8Array(info.size);
+            } catch (error) {
+                rejection = { code: 'too-large', reason: `Receiver could not allocate ${info.size} bytes` };
+            }
+        }
+        if (rejection) {
+            this.logger.warn(`Refusing file ${info.name} for transfer ${transferId}: ${rejection.reason}`);
+            
+            const message = {
+                type: 'file-rejected',
+                transferId: transferId,
+                code: rejection.code,
+                reason: rejection.reason
+            };
+            this.p2p.sendControlMessage(message);
+            
+            if (this.onError) {
+                this.onError(new Error(`Refused incoming file ${info.name}: ${rejection.reason}`));
+            }
+            return;
+        }
+        
         // Prefix the incoming transfer ID to avoid collision with our own sending transfers
         const localTransferId = `recv-${transferId}`;
         
@@ -990,8 +2538,11 @@ class FileTransfer {
             totalChunks: totalChunks,
             chunks: new Array(totalChunks).fill(false),
             highestSequence: 0,
-            fileData: new Uint8Array(info.size),
-            lastProgressUpdate: 0
+            fileData: fileData,
+            lastProgressUpdate: 0,
+            unackedChunks: 0,
+            ackTimer: null,
+            lastChunkTime: Date.now()
         };
         
         // Store transfer data using local transfer ID
@@ -1014,6 +2565,8 @@ class FileTransfer {
             this.chunks = transferData.chunks;
         }
         
+        this._startWatchdog();
+        
         this.logger.log(`Starting file reception for transfer ${transferId}: ${info.name} (${info.size} bytes)`);
         this.logger.log(`Using chunk size: ${chunkSize} bytes`);
         this.logger.log(`Total chunks: ${totalChunks}`);
@@ -1102,7 +2655,10 @@ class FileTransfer {
             const newAcknowledged = ack.highestSequence - transferData.lastAcknowledged;
             transferData.inFlightChunks = Math.max(0, transferData.inFlightChunks - newAcknowledged);
             transferData.lastAcknowledged = ack.highestSequence;
+            transferData.lastAckTime = Date.now();
             this.logger.log('DEBUG: Transfer', transferData.id, 'state after update - inFlightChunks:', transferData.inFlightChunks, 'lastAcknowledged:', transferData.lastAcknowledged);
+            
+            this._checkSlowConsumerRecovered(transferData);
         }
         
         // CRITICAL FIX: Remove legacy state updates to prevent conflicts
@@ -1110,6 +2666,49 @@ class FileTransfer {
         // Legacy state updates removed to prevent dual flow control conflicts
     }
     
+    /**
+     * Detect a receiver whose acknowledgments have stalled and shrink the send window
+     * @param {Object} transferData - The transfer data
+     * @private
+     */
+    _checkSlowConsumer(transferData) {
+        if (transferData.slowConsumer || transferData.inFlightChunks === 0) {
+            return;
+        }
+        
+        // Allow for the receiver deliberately holding acks back
+        const ackLag = Date.now() - transferData.lastAckTime;
+        if (ackLag < this.ackLagThreshold + this.p2p.negotiatedAckDelay) {
+            return;
+        }
+        
+        const controlBacklog = this.p2p.controlChannel ? this.p2p.controlChannel.bufferedAmount : 0;
+        transferData.slowConsumer = true;
+        transferData.windowBeforeSlowConsumer = transferData.windowSize;
+        transferData.windowSize = Math.max(transferData.minWindowSize, Math.floor(transferData.windowSize / 2));
+        
+        this.logger.warn(`Slow consumer detected for transfer ${transferData.id}: ${transferData.inFlightChunks} chunks unacknowledged for ${ackLag}ms (control backlog: ${controlBacklog} bytes), shrinking window to ${transferData.windowSize}`);
+    }
+    
+    /**
+     * Restore the send window once a slow receiver has caught up
+     * @param {Object} transferData - The transfer data
+     * @private
+     */
+    _checkSlowConsumerRecovered(transferData) {
+        if (!transferData.slowConsumer || transferData.inFlightChunks >= transferData.windowSize / 2) {
+            return;
+        }
+        
+        transferData.slowConsumer = false;
+        if (transferData.windowBeforeSlowConsumer !== null) {
+            transferData.windowSize = transferData.windowBeforeSlowConsumer;
+            transferData.windowBeforeSlowConsumer = null;
+        }
+        
+        this.logger.log(`Receiver caught up for transfer ${transferData.id}, restoring window to ${transferData.windowSize}`);
+    }
+    
     /**
      * Adjust window size for specific transfer based on network conditions
      * @param {Object} transferData - The transfer data
@@ -1332,8 +2931,9 @@ class FileTransfer {
      * @private
      */
     _handleDataMessage(data) {
-        // Check if we have enough data for the header (12 bytes with transfer ID)
-        if (data.byteLength < 12) {
+        // Check if we have enough data for the header (12 bytes with transfer ID, 16 with checksum)
+        const headerSize = this._getChunkHeaderSize();
+        if (data.byteLength < headerSize) {
             this.logger.warn(`Received invalid chunk: too short (${data.byteLength} bytes)`);
             return;
         }
@@ -1345,8 +2945,8 @@ class FileTransfer {
         const chunkSize = view.getUint32(8);
         
         // Validate chunk size
-        if (data.byteLength !== 12 + chunkSize) {
-            this.logger.warn(`Chunk size mismatch: expected ${12 + chunkSize}, got ${data.byteLength}`);
+        if (data.byteLength !== headerSize + chunkSize) {
+            this.logger.warn(`Chunk size mismatch: expected ${headerSize + chunkSize}, got ${data.byteLength}`);
             return;
         }
         
@@ -1367,7 +2967,7 @@ class FileTransfer {
         
         if (!transferData) {
             // Fallback to legacy handling ONLY for single transfers (not when multiple transfers are active)
-            if (this.activeTransfers.size === 1 && this.receiving && this.fileInfo && this.fileData) {
+            if (!this.p2p.fileOffers && this.activeTransfers.size === 1 && this.receiving && this.fileInfo && this.fileData) {
                 this._handleLegacyDataMessage(data, view, sequence, chunkSize);
                 return;
             }
@@ -1390,32 +2990,84 @@ class FileTransfer {
      * @param {number} chunkSize - The chunk size
      * @private
      */
-    _handleDataMessageForTransfer(transferId, transferData, data, view, sequence, chunkSize) {
+    async _handleDataMessageForTransfer(transferId, transferData, data, view, sequence, chunkSize) {
+        // Extract chunk data
+        let chunkData = new Uint8Array(data, this._getChunkHeaderSize(), chunkSize);
+        
+        // Verify the chunk checksum and re-request corrupted chunks immediately
+        if (this.p2p.chunkChecksumsEnabled) {
+            const expectedChecksum = view.getUint32(12);
+            const actualChecksum = this._crc32(chunkData);
+            if (actualChecksum !== expectedChecksum) {
+                this.logger.warn(`Checksum mismatch for chunk ${sequence} of transfer ${transferId} (expected ${expectedChecksum}, got ${actualChecksum})`);
+                this._requestChunksForTransfer(transferId, transferData, [sequence]);
+                return;
+            }
+        }
+        
+        // Decrypt the payload if end-to-end encryption was negotiated
+        await this.p2p.waitForEncryption();
+        if (this.p2p.encryptionEnabled) {
+            try {
+                chunkData = new Uint8Array(await this.p2p.decryptChunk(chunkData, transferData.numericId, sequence));
+            } catch (error) {
+                this.logger.warn(`Failed to decrypt chunk ${sequence} of transfer ${transferId}, re-requesting`);
+                this._requestChunksForTransfer(transferId, transferData, [sequence]);
+                return;
+            }
+            
+            // The transfer may have been cancelled while decrypting
+            if (!transferData.receiving) {
+                return;
+            }
+        }
+        
+        // Decompress if the sender flagged the payload as compressed
+        if (this.p2p.compressionFormat && (view.getUint8(this._getChunkHeaderSize() - 1) & CHUNK_FLAG_COMPRESSED)) {
+            try {
+                chunkData = await this._transformChunk(chunkData, new DecompressionStream(this.p2p.compressionFormat), transferData.chunkSize);
+            } catch (error) {
+                this.logger.warn(`Failed to decompress chunk ${sequence} of transfer ${transferId}, re-requesting`);
+                this._requestChunksForTransfer(transferId, transferData, [sequence]);
+                return;
+            }
+            
+            if (!chunkData) {
+                this.logger.warn(`Decompressed chunk ${sequence} of transfer ${transferId} exceeds the chunk size, dropping it`);
+                return;
+            }
+            
+            if (!transferData.receiving) {
+                return;
+            }
+        }
+        
         // Calculate offset in file
         const offset = sequence * transferData.chunkSize;
         
         // Validate offset
-        if (offset + chunkSize > transferData.file.size) {
-            this.logger.warn(`Invalid chunk offset: ${offset + chunkSize} exceeds file size ${transferData.file.size} for transfer ${transferId}`);
+        if (offset + chunkData.length > transferData.file.size) {
+            this.logger.warn(`Invalid chunk offset: ${offset + chunkData.length} exceeds file size ${transferData.file.size} for transfer ${transferId}`);
             return;
         }
         
-        // Extract chunk data
-        const chunkData = new Uint8Array(data, 12, chunkSize);
-        
         // Write chunk to transfer-specific file data
         transferData.fileData.set(chunkData, offset);
         
         // Mark chunk as received
+        transferData.lastChunkTime = Date.now();
         if (!transferData.chunks[sequence]) {
             transferData.chunks[sequence] = true;
             transferData.receivedChunks++;
-            transferData.bytesReceived += chunkSize;
+            transferData.bytesReceived += chunkData.length;
+            this._sampleTransferStats(transferData, transferData.bytesReceived);
             
             // Update highest sequence
             if (sequence > transferData.highestSequence) {
                 transferData.highestSequence = sequence;
             }
+        } else {
+            transferData.duplicateChunks = (transferData.duplicateChunks || 0) + 1;
         }
         
         // Send transfer-specific progress update (which includes flow control ack)
@@ -1534,13 +3186,14 @@ class FileTransfer {
             const blob = new Blob([transferData.fileData], { type: 'application/octet-stream' });
             
             // Calculate MD5 hash
-            const md5Hash = await this._calculateMD5(blob);
+            const md5Hash = await this._calculateMD5(blob, this._createHashProgressReporter(transferId, 'verifying', transferData.file.name));
             
             // Get file info from transfer data
             const fileInfo = {
                 name: transferData.file.name,
                 size: transferData.file.size,
-                md5: transferData.file.md5
+                md5: transferData.file.md5,
+                path: transferData.file.path
             };
             
             // Compare with expected hash
@@ -1556,10 +3209,12 @@ class FileTransfer {
                     transferId: msgTransferId
                 };
                 
-                this.p2p.controlChannel.send(JSON.stringify(message));
+                this.p2p.sendControlMessage(message);
+                this._sendTransferReport(transferData, msgTransferId, md5Hash);
                 
                 // Complete transfer
                 transferData.receiving = false;
+                this._recordTransferOutcome(transferData, true);
                 
                 // Send final progress update to ensure UI is synchronized
                 if (this.onProgress) {
@@ -1601,10 +3256,12 @@ class FileTransfer {
                     reason: 'MD5 hash mismatch'
                 };
                 
-                this.p2p.controlChannel.send(JSON.stringify(message));
+                this.p2p.sendControlMessage(message);
+                this._sendTransferReport(transferData, msgTransferId, md5Hash);
                 
                 // Complete transfer with error
                 transferData.receiving = false;
+                this._recordTransferOutcome(transferData, false);
                 
                 if (this.onVerificationFailed) {
                     this.onVerificationFailed('MD5 hash mismatch');
@@ -1620,10 +3277,11 @@ class FileTransfer {
                 reason: error.message
             };
             
-            this.p2p.controlChannel.send(JSON.stringify(message));
+            this.p2p.sendControlMessage(message);
             
             // Complete transfer with error
             transferData.receiving = false;
+            this._recordTransferOutcome(transferData, false);
             
             if (this.onVerificationFailed) {
                 this.onVerificationFailed(error.message);
@@ -1653,7 +3311,7 @@ class FileTransfer {
             const blob = new Blob([this.fileData], { type: 'application/octet-stream' });
             
             // Calculate MD5 hash
-            const md5Hash = await this._calculateMD5(blob);
+            const md5Hash = await this._calculateMD5(blob, this._createHashProgressReporter(null, 'verifying', this.fileInfo.name));
             
             // Compare with expected hash
             if (md5Hash === this.fileInfo.md5) {
@@ -1664,7 +3322,7 @@ class FileTransfer {
                     type: 'file-verified'
                 };
                 
-                this.p2p.controlChannel.send(JSON.stringify(message));
+                this.p2p.sendControlMessage(message);
                 
                 // Complete transfer
                 this.receiving = false;
@@ -1703,7 +3361,7 @@ class FileTransfer {
                     reason: 'MD5 hash mismatch'
                 };
                 
-                this.p2p.controlChannel.send(JSON.stringify(message));
+                this.p2p.sendControlMessage(message);
                 
                 // Complete transfer with error
                 this.receiving = false;
@@ -1721,7 +3379,7 @@ class FileTransfer {
                 reason: error.message
             };
             
-            this.p2p.controlChannel.send(JSON.stringify(message));
+            this.p2p.sendControlMessage(message);
             
             // Complete transfer with error
             this.receiving = false;
@@ -1738,7 +3396,7 @@ class FileTransfer {
      * @returns {Promise<string>} - The MD5 hash
      * @private
      */
-    async _calculateMD5(file) {
+    async _calculateMD5(file, onProgress = null) {
         return new Promise((resolve, reject) => {
             if (typeof SparkMD5 === 'undefined') {
                 reject(new Error('SparkMD5 library not loaded'));
@@ -1755,6 +3413,10 @@ class FileTransfer {
                 try {
                     spark.append(e.target.result);
                     currentChunk++;
+                    
+                    if (onProgress) {
+                        onProgress(Math.min(currentChunk * chunkSize, file.size), file.size);
+                    }
 
                     if (currentChunk < chunks) {
                         loadNext();
@@ -1783,6 +3445,39 @@ class FileTransfer {
         });
     }
 
+    /**
+     * Build a throttled progress callback for _calculateMD5
+     * @param {string|null} transferId - The transfer being hashed
+     * @param {string} phase - 'hashing' before sending, 'verifying' after receiving
+     * @param {string} filename - The file name
+     * @returns {Function} - Callback taking (bytesHashed, totalBytes)
+     * @private
+     */
+    _createHashProgressReporter(transferId, phase, filename) {
+        const startTime = Date.now();
+        let lastReport = 0;
+        
+        return (bytesHashed, totalBytes) => {
+            const now = Date.now();
+            const done = bytesHashed >= totalBytes;
+            if (!this.onHashProgress || (!done && now - lastReport < 250)) {
+                return;
+            }
+            lastReport = now;
+            
+            const elapsed = (now - startTime) / 1000;
+            this.onHashProgress({
+                transferId: transferId,
+                phase: phase,
+                filename: filename,
+                bytesHashed: bytesHashed,
+                totalBytes: totalBytes,
+                percent: totalBytes > 0 ? (bytesHashed / totalBytes) * 100 : 100,
+                speed: elapsed > 0 ? bytesHashed / elapsed : 0
+            });
+        };
+    }
+
     /**
      * Adjust window size based on network conditions and performance
      * @param {number} currentSpeed - Current transfer speed in bytes per second
@@ -106,8 +106,18 @@ function initUI() {
         fileTransferPanel: document.getElementById('file-transfer-panel'),
         fileInput: document.getElementById('file-input'),
         fileSelectButton: document.getElementById('file-select-button'),
+        folderInput: document.getElementById('folder-input'),
+        folderSelectButton: document.getElementById('folder-select-button'),
         selectedFileName: document.getElementById('selected-file-name'),
         sendFileButton: document.getElementById('send-file-button'),
+        sendPriority: document.getElementById('send-priority'),
+        sendAtInput: document.getElementById('send-at-input'),
+        sendQueueList: document.getElementById('send-queue-list'),
+        rateLimitInput: document.getElementById('rate-limit-input'),
+        maxDurationInput: document.getElementById('max-duration-input'),
+        receiveMemoryInput: document.getElementById('receive-memory-input'),
+        blockedExtensionsInput: document.getElementById('blocked-extensions-input'),
+        blockedHashesInput: document.getElementById('blocked-hashes-input'),
         transferProgressContainer: document.getElementById('transfer-progress-container'),
         transferProgress: document.getElementById('transfer-progress'),
         transferFilename: document.getElementById('transfer-filename'),
@@ -131,7 +141,22 @@ function initUI() {
         chatPanel: document.getElementById('chat-panel'),
         chatMessages: document.getElementById('chat-messages'),
         chatInput: document.getElementById('chat-input'),
+        chatPeerStatus: document.getElementById('chat-peer-status'),
+        snippetSection: document.getElementById('snippet-section'),
+        snippetInput: document.getElementById('snippet-input'),
+        snippetName: document.getElementById('snippet-name'),
+        sendSnippetButton: document.getElementById('send-snippet-button'),
+        iceServersInput: document.getElementById('ice-servers-input'),
+        autoAcceptPolicy: document.getElementById('auto-accept-policy'),
         sendMessageButton: document.getElementById('send-message-button'),
+        securityCodeDisplay: document.getElementById('security-code-display'),
+        securityCode: document.getElementById('security-code'),
+        noEncryptionNotice: document.getElementById('no-encryption-notice'),
+        peerIdentity: document.getElementById('peer-identity'),
+        peerFingerprint: document.getElementById('peer-fingerprint'),
+        peerTrustedBadge: document.getElementById('peer-trusted-badge'),
+        ownFingerprint: document.getElementById('own-fingerprint'),
+        trustPeer: document.getElementById('trust-peer'),
         
         // Status log panel
         statusLogPanel: document.getElementById('status-log-panel'),
@@ -140,7 +165,26 @@ function initUI() {
         
         // Connection request modal
         connectionRequestModal: document.getElementById('connection-request-modal'),
+        fileOfferModal: document.getElementById('file-offer-modal'),
+        fileOfferName: document.getElementById('file-offer-name'),
+        fileOfferSize: document.getElementById('file-offer-size'),
+        fileOfferHash: document.getElementById('file-offer-hash'),
+        fileOfferFolderNote: document.getElementById('file-offer-folder-note'),
+        acceptFile: document.getElementById('accept-file'),
+        declineFile: document.getElementById('decline-file'),
+        autoAcceptFiles: document.getElementById('auto-accept-files'),
+        desktopNotifications: document.getElementById('desktop-notifications'),
+        transferSummaryList: document.getElementById('transfer-summary-list'),
+        downloadTransferLog: document.getElementById('download-transfer-log'),
+        pingButton: document.getElementById('ping-button'),
+        speedtestButton: document.getElementById('speedtest-button'),
+        conninfoButton: document.getElementById('conninfo-button'),
+        statsButton: document.getElementById('stats-button'),
+        diagnosticsOutput: document.getElementById('diagnostics-output'),
         requestPeerToken: document.getElementById('request-peer-token'),
+        requestIdentity: document.getElementById('request-identity'),
+        requestFingerprint: document.getElementById('request-fingerprint'),
+        requestTrusted: document.getElementById('request-trusted'),
         rejectConnection: document.getElementById('reject-connection'),
         acceptConnection: document.getElementById('accept-connection'),
         
@@ -208,6 +252,23 @@ function initUI() {
         }
     }
     
+    // Show a desktop notification, if enabled, while the page is in the background
+    function notify(title, body) {
+        if (!elements.desktopNotifications.checked || !('Notification' in window) ||
+            Notification.permission !== 'granted' || !document.hidden) {
+            return;
+        }
+        try {
+            const notification = new Notification(title, { body, tag: 'p2pftp' });
+            notification.onclick = () => {
+                window.focus();
+                notification.close();
+            };
+        } catch (error) {
+            logger.debug('Could not show notification:', error);
+        }
+    }
+    
     // Add log entry to the log container
     function addLogEntry(level, message) {
         // Check current number of log entries and trim if exceeding 100
@@ -241,6 +302,10 @@ function initUI() {
         
         transferHistory.unshift(historyItem);
         
+        const outcome = historyItem.error ? `Failed: ${historyItem.error}` : historyItem.status;
+        notify(`${historyItem.type === 'sent' ? 'Sent' : 'Received'} ${historyItem.filename}`,
+            `${outcome} (${historyItem.filesize})`);
+        
         // Keep only last 10 transfers
         if (transferHistory.length > 10) {
             transferHistory = transferHistory.slice(0, 10);
@@ -332,6 +397,11 @@ function initUI() {
         return (bytes / Math.pow(k, i)).toFixed(dm) + ' ' + sizes[i];
     }
     
+    // Build a download filename, flattening directory paths since browsers can't create folders
+    function getDownloadName(fileInfo) {
+        return fileInfo.path ? fileInfo.path.replace(/\//g, '_') : fileInfo.name;
+    }
+    
     // Format seconds to MM:SS format
     function formatTime(seconds) {
         if (!isFinite(seconds) || seconds < 0) {
@@ -347,6 +417,47 @@ function initUI() {
     // Initialize P2P connection
     const p2p = new P2PConnection(logger);
     
+    // Pin the operator's config signing key if the link carries one
+    const pinnedConfigKey = new URLSearchParams(window.location.search).get('configkey');
+    if (pinnedConfigKey) {
+        p2p.pinnedConfigKey = pinnedConfigKey;
+        logger.log('Requiring signed ICE configuration');
+    }
+    
+    // Pass the server's shared secret along if the link carries one
+    const authToken = new URLSearchParams(window.location.search).get('auth');
+    if (authToken) {
+        p2p.authToken = authToken;
+    }
+    
+    // The user's own STUN/TURN servers, one "url[,url] [username credential]" per line
+    elements.iceServersInput.value = p2p.localIceServers
+        .map(server => [server.urls.join(','), server.username, server.credential].filter(Boolean).join(' '))
+        .join('\n');
+    elements.iceServersInput.addEventListener('change', () => {
+        const servers = elements.iceServersInput.value.split('\n')
+            .map(line => line.trim().split(/\s+/))
+            .filter(fields => fields[0])
+            .map(([urls, username, credential]) => {
+                const server = { urls: urls.split(',').filter(Boolean) };
+                if (username) {
+                    server.username = username;
+                    server.credential = credential || '';
+                }
+                return server;
+            });
+        try {
+            p2p.setLocalIceServers(servers);
+        } catch (error) {
+            logger.error('Extra ICE servers not saved:', error.message);
+        }
+    });
+    
+    elements.autoAcceptPolicy.value = p2p.autoAcceptPolicy;
+    elements.autoAcceptPolicy.addEventListener('change', () => {
+        p2p.setAutoAcceptPolicy(elements.autoAcceptPolicy.value);
+    });
+    
     // Initialize file transfer
     const fileTransfer = new FileTransfer(p2p, logger);
     
@@ -409,7 +520,9 @@ function initUI() {
     p2p.onTokenReceived = (token) => {
         // Display token and connection link
         elements.myToken.textContent = token;
-        elements.connectionLink.value = `https://${elements.serverUrl.value}/?token=${token}`;
+        elements.connectionLink.value = `https://${elements.serverUrl.value}/?token=${token}` +
+            (pinnedConfigKey ? `&configkey=${encodeURIComponent(pinnedConfigKey)}` : '') +
+            (authToken ? `&auth=${encodeURIComponent(authToken)}` : '');
         elements.tokenDisplay.classList.remove('hidden');
         
         // Disable connect to server button since we're already connected
@@ -429,12 +542,16 @@ function initUI() {
         }
     };
     
-    p2p.onConnectionRequest = (peerToken) => {
+    p2p.onConnectionRequest = (peerToken, identity) => {
         // Play alert sound
         playAlertSound();
+        notify('Connection request', identity ? `From ${identity.fingerprint}` : `From ${peerToken}`);
         
-        // Show connection request modal
+        // Show connection request modal, with the requester's identity if it signed the request
         elements.requestPeerToken.textContent = peerToken;
+        elements.requestIdentity.classList.toggle('hidden', !identity);
+        elements.requestFingerprint.textContent = identity ? identity.fingerprint : '';
+        elements.requestTrusted.classList.toggle('hidden', !(identity && identity.trusted));
         elements.connectionRequestModal.classList.remove('hidden');
         
         // Store peer token for accept/reject
@@ -446,6 +563,167 @@ function initUI() {
         addChatMessage(message, false);
     };
     
+    p2p.onSnippet = (snippet) => {
+        addSnippetMessage(snippet.content, snippet.name, false);
+    };
+    
+    // Show "Peer is typing…" until the notices stop, then active or last seen
+    let peerTypingTimer = null;
+    p2p.onPeerPresence = (presence) => {
+        clearTimeout(peerTypingTimer);
+        if (presence.typing) {
+            elements.chatPeerStatus.textContent = 'Peer is typing…';
+            peerTypingTimer = setTimeout(() => showPeerPresence(p2p.peerActive, p2p.peerLastSeen), p2p.typingTimeout);
+        } else {
+            showPeerPresence(presence.active, presence.lastSeen);
+        }
+    };
+    
+    function showPeerPresence(active, lastSeen) {
+        const seen = new Date(lastSeen).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+        elements.chatPeerStatus.textContent = active ? 'Active' : `Idle, last seen ${seen}`;
+    }
+    
+    // Report idle after a minute without input, or while the tab is hidden
+    const idleAfter = 60000;
+    let idleTimer = null;
+    function markActive() {
+        clearTimeout(idleTimer);
+        idleTimer = setTimeout(() => p2p.setPresence(false), idleAfter);
+        p2p.setPresence(true);
+    }
+    ['keydown', 'pointerdown', 'pointermove'].forEach(type => {
+        document.addEventListener(type, markActive, { passive: true });
+    });
+    document.addEventListener('visibilitychange', () => {
+        if (document.hidden) {
+            clearTimeout(idleTimer);
+            p2p.setPresence(false);
+        } else {
+            markActive();
+        }
+    });
+    markActive();
+    
+    p2p.onPeerCapabilities = (capabilities) => {
+        // A new session starts with nothing accepted
+        fileTransfer.resetOffers();
+        
+        // Grey out chat input if the peer will never display our messages
+        const chatAvailable = capabilities.chat !== false;
+        elements.chatInput.disabled = !chatAvailable;
+        elements.sendMessageButton.disabled = !chatAvailable;
+        elements.chatInput.placeholder = chatAvailable ? 'Type a message...' : 'Peer does not accept chat messages';
+        if (!chatAvailable) {
+            logger.log('Peer has chat disabled, chat input greyed out');
+        }
+        elements.chatPeerStatus.textContent = p2p.peerPresenceEnabled ? 'Active' : '';
+        elements.snippetSection.classList.toggle('hidden', !p2p.peerSnippets);
+    };
+    
+    p2p.onEncryptionReady = (securityCode) => {
+        // Show the short authentication string for out-of-band verification
+        elements.securityCode.textContent = securityCode;
+        elements.securityCodeDisplay.classList.remove('hidden');
+        elements.noEncryptionNotice.classList.add('hidden');
+        // Shown again if this peer proves an identity
+        elements.peerIdentity.classList.add('hidden');
+    };
+    
+    p2p.onEncryptionUnavailable = () => {
+        // Without a payload key there's no security code and no identity to trust
+        logger.warn('Connection is not end-to-end encrypted');
+        elements.securityCodeDisplay.classList.add('hidden');
+        elements.peerIdentity.classList.add('hidden');
+        elements.noEncryptionNotice.classList.remove('hidden');
+    };
+    
+    p2p.onPeerIdentity = (identity) => {
+        // Only shown once the peer signed this session's keys, so it rides on the security code
+        const trusted = p2p.isPeerTrusted();
+        elements.peerFingerprint.textContent = identity.fingerprint;
+        elements.ownFingerprint.textContent = p2p.identityFingerprint || 'unavailable';
+        elements.trustPeer.checked = trusted;
+        elements.peerTrustedBadge.classList.toggle('hidden', !trusted);
+        elements.peerIdentity.classList.remove('hidden');
+        if (trusted) {
+            logger.log(`Connected to trusted peer ${identity.fingerprint}`);
+        }
+    };
+    
+    elements.trustPeer.addEventListener('change', () => {
+        try {
+            p2p.setPeerTrusted(elements.trustPeer.checked);
+            elements.peerTrustedBadge.classList.toggle('hidden', !elements.trustPeer.checked);
+        } catch (error) {
+            elements.trustPeer.checked = false;
+            logger.error('Could not update peer trust:', error.message);
+        }
+    });
+    
+    // Incoming file offers are shown one at a time
+    const pendingFileOffers = [];
+    
+    function showNextFileOffer() {
+        if (pendingFileOffers.length === 0) {
+            elements.fileOfferModal.classList.add('hidden');
+            return;
+        }
+        
+        const { info } = pendingFileOffers[0];
+        elements.fileOfferName.textContent = info.path || info.name;
+        elements.fileOfferSize.textContent = formatBytes(info.size);
+        elements.fileOfferHash.textContent = info.md5 || 'unknown';
+        elements.fileOfferFolderNote.classList.toggle('hidden', !info.dirId);
+        elements.fileOfferModal.classList.remove('hidden');
+    }
+    
+    function answerFileOffer(accepted) {
+        const offer = pendingFileOffers.shift();
+        if (offer) {
+            offer.resolve(accepted);
+        }
+        showNextFileOffer();
+    }
+    
+    fileTransfer.onFileOffer = (info) => {
+        if (p2p.isPeerTrusted()) {
+            logger.log(`Accepting ${info.path || info.name} from trusted peer ${p2p.peerIdentity.fingerprint}`);
+            return true;
+        }
+        
+        playAlertSound();
+        notify('Incoming file', `${info.path || info.name} (${formatBytes(info.size)})`);
+        return new Promise(resolve => {
+            pendingFileOffers.push({ info, resolve });
+            if (pendingFileOffers.length === 1) {
+                showNextFileOffer();
+            }
+        });
+    };
+    
+    p2p.onResumeFromSleep = (healthy) => {
+        if (healthy) {
+            logger.log('Connection still alive after sleep, resuming transfers');
+            fileTransfer.resumeAfterSleep();
+            return;
+        }
+        
+        // Paused transfers can't continue, so say so instead of waiting forever
+        _updateConnectionStatus('Peer lost after sleep - reconnect to continue');
+        fileTransfer.resetOffers();
+        if (elements.disconnectionModal) {
+            elements.disconnectionModal.classList.remove('hidden');
+        }
+    };
+    
+    p2p.onPeerReachability = (reachable) => {
+        fileTransfer.setPeerReachable(reachable);
+        _updateConnectionStatus(reachable ?
+            'Peer reachable again' :
+            'Peer unreachable - no heartbeat, transfers paused');
+    };
+    
     p2p.onError = (error) => {
         logger.error('P2P error:', error);
         // Hide peer connection spinner on error
@@ -460,6 +738,9 @@ function initUI() {
     
     p2p.onPeerDisconnect = () => {
         logger.warn('Peer connection closed');
+        clearTimeout(peerTypingTimer);
+        elements.chatPeerStatus.textContent = '';
+        fileTransfer.resetOffers();
         
         // Show disconnection modal
         if (elements.disconnectionModal) {
@@ -901,6 +1182,211 @@ function initUI() {
         }
     };
     
+    // List queued files, with a Remove button on those that haven't started
+    fileTransfer.onQueueChange = (entries) => {
+        elements.sendQueueList.innerHTML = '';
+        for (const entry of entries) {
+            const item = document.createElement('li');
+            const label = document.createElement('span');
+            const priority = entry.priority > 0 ? 'high' : entry.priority < 0 ? 'low' : 'normal';
+            let text = `${entry.name} (${formatBytes(entry.size)}, ${priority} priority) - ${entry.state}`;
+            if (entry.state === 'waiting' && entry.startAt) {
+                text += ` until ${new Date(entry.startAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}`;
+            }
+            label.textContent = text;
+            item.appendChild(label);
+            
+            if (entry.state === 'waiting') {
+                const remove = document.createElement('button');
+                remove.textContent = 'Remove';
+                remove.className = 'ml-2 text-xs text-red-600 hover:underline';
+                remove.addEventListener('click', () => fileTransfer.removeFromQueue(entry.id));
+                item.appendChild(remove);
+            }
+            elements.sendQueueList.appendChild(item);
+        }
+    };
+    
+    /**
+     * Turn an HH:MM start time into the next such moment
+     * @param {string} value - The time input's value
+     * @returns {number|null} - ms since the epoch, or null to start now
+     */
+    function parseStartTime(value) {
+        if (!value) {
+            return null;
+        }
+        const [hours, minutes] = value.split(':').map(Number);
+        const start = new Date();
+        start.setHours(hours, minutes, 0, 0);
+        if (start.getTime() <= Date.now()) {
+            start.setDate(start.getDate() + 1);
+        }
+        return start.getTime();
+    }
+    
+    fileTransfer.onDirectoryInfo = (manifest) => {
+        logger.log(`Peer is sending directory ${manifest.name} (${manifest.files.length} files, ${formatBytes(manifest.totalSize)})`);
+    };
+    
+    fileTransfer.onTransferSummary = (summary) => {
+        const entry = document.createElement('div');
+        const outcome = summary.success ? 'ok' : 'FAILED';
+        let text = `${summary.direction === 'send' ? '↑' : '↓'} ${summary.name} ${outcome} - ` +
+            `${formatBytes(summary.bytes)} in ${(summary.duration / 1000).toFixed(1)}s, ` +
+            `avg ${formatBytes(summary.averageSpeed)}/s, peak ${formatBytes(summary.peakSpeed)}/s, ` +
+            `${summary.retransmittedChunks} retransmitted`;
+        if (summary.window) {
+            text += `, window ${summary.window.min}-${summary.window.max}`;
+        }
+        if (summary.direction === 'receive') {
+            text += `, ${summary.duplicateChunks} duplicate, ${summary.requestedChunks} re-requested`;
+        }
+        entry.textContent = text;
+        entry.className = summary.success ? '' : 'text-red-600';
+        elements.transferSummaryList.prepend(entry);
+    };
+    
+    // What the receiver saw of a file we sent, shown under its summary
+    fileTransfer.onReceiverReport = (summary, report) => {
+        const entry = document.createElement('div');
+        entry.textContent = `  receiver: ${formatBytes(report.bytes)} in ${(report.duration / 1000).toFixed(1)}s, ` +
+            `${report.duplicateChunks} duplicate, ${report.requestedChunks} re-requested, ` +
+            (report.hashMatches ? 'hash matches' : `hash differs (${report.md5 || 'none'})`);
+        entry.className = report.hashMatches ? 'text-gray-500' : 'text-red-600';
+        elements.transferSummaryList.prepend(entry);
+    };
+    
+    // Connection diagnostics
+    function addDiagnosticsLine(text, failed) {
+        const line = document.createElement('div');
+        line.textContent = text;
+        if (failed) {
+            line.className = 'text-red-600';
+        }
+        elements.diagnosticsOutput.prepend(line);
+    }
+    
+    function describeCandidatePair(pair) {
+        if (!pair) {
+            return 'path unknown';
+        }
+        return `path ${pair.localType}/${pair.remoteType} over ${pair.protocol}`;
+    }
+    
+    elements.conninfoButton.addEventListener('click', async () => {
+        const info = await p2p.getConnectionInfo().catch(() => null);
+        if (!info) {
+            addDiagnosticsLine('Connection info unavailable: no selected candidate pair', true);
+            return;
+        }
+        addDiagnosticsLine(`${info.label}: local ${info.localAddress} (${info.localType}), ` +
+            `remote ${info.remoteAddress} (${info.remoteType}) over ${info.protocol}` +
+            (info.rtt !== null ? `, RTT ${info.rtt.toFixed(1)} ms` : ''));
+    });
+    
+    elements.statsButton.addEventListener('click', async () => {
+        const stats = await p2p.getStats().catch(() => null);
+        if (!stats) {
+            addDiagnosticsLine('Stats unavailable: not connected to a peer', true);
+            return;
+        }
+        
+        // Lines are prepended, so add the transfers first to list them under the summary
+        for (const transfer of fileTransfer.getTransferStats().reverse()) {
+            addDiagnosticsLine(transfer.direction === 'send' ?
+                `  ${transfer.id} ${transfer.name}: window ${transfer.windowSize}, ${transfer.inFlightChunks} in flight, ` +
+                    `${transfer.retransmittedChunks} retransmitted${transfer.paused ? ', paused' : ''}` :
+                `  ${transfer.id} ${transfer.name}: ${transfer.missingChunks} chunks missing, ${transfer.unackedChunks} unacknowledged`);
+        }
+        addDiagnosticsLine(`Stats: sent ${formatBytes(stats.bytesSent)} (${stats.messagesSent} messages), ` +
+            `received ${formatBytes(stats.bytesReceived)} (${stats.messagesReceived} messages), ` +
+            `${formatBytes(stats.bufferedAmount)} buffered` +
+            (stats.rtt !== null ? `, RTT ${stats.rtt.toFixed(1)} ms` : '') +
+            (stats.availableOutgoingBitrate !== null ? `, outgoing estimate ${formatBytes(stats.availableOutgoingBitrate / 8)}/s` : ''));
+    });
+    
+    elements.pingButton.addEventListener('click', async () => {
+        elements.pingButton.disabled = true;
+        try {
+            const rtt = await p2p.ping();
+            const pair = await p2p.getSelectedCandidatePair();
+            addDiagnosticsLine(`Ping: ${rtt.toFixed(1)} ms, ${describeCandidatePair(pair)}`);
+        } catch (error) {
+            addDiagnosticsLine(`Ping failed: ${error.message}`, true);
+        } finally {
+            elements.pingButton.disabled = false;
+        }
+    });
+    
+    elements.speedtestButton.addEventListener('click', async () => {
+        // Filler chunks would compete with, and skew, a real transfer
+        if (fileTransfer.activeTransfers.size > 0) {
+            addDiagnosticsLine('Speed test skipped: a transfer is in progress', true);
+            return;
+        }
+        
+        elements.speedtestButton.disabled = true;
+        addDiagnosticsLine('Speed test running...');
+        try {
+            const result = await p2p.runSpeedTest();
+            const lost = result.sentFrames - result.receivedFrames;
+            addDiagnosticsLine(`Speed test: ${formatBytes(result.throughput)}/s, ` +
+                `${formatBytes(result.receivedBytes)} in ${(result.duration / 1000).toFixed(1)}s, ` +
+                `RTT ${result.rtt.toFixed(1)} ms, ${lost} of ${result.sentFrames} chunks lost, ` +
+                describeCandidatePair(result.candidatePair));
+        } catch (error) {
+            addDiagnosticsLine(`Speed test failed: ${error.message}`, true);
+        } finally {
+            elements.speedtestButton.disabled = false;
+        }
+    });
+    
+    // Export the summaries as JSON Lines
+    elements.downloadTransferLog.addEventListener('click', () => {
+        const blob = new Blob([fileTransfer.getTransferLog()], { type: 'application/x-ndjson' });
+        const url = URL.createObjectURL(blob);
+        const a = document.createElement('a');
+        a.href = url;
+        a.download = 'transfers.log';
+        document.body.appendChild(a);
+        a.click();
+        setTimeout(() => {
+            document.body.removeChild(a);
+            URL.revokeObjectURL(url);
+        }, 100);
+    });
+    
+    fileTransfer.onHashProgress = (progress) => {
+        const label = progress.phase === 'hashing' ? 'Hashing' : 'Verifying';
+        const text = `${label} ${Math.floor(progress.percent)}% (${formatBytes(progress.speed)}/s)`;
+        
+        if (!progress.transferId) {
+            elements.transferStatus.textContent = text;
+            return;
+        }
+        
+        // Senders hash before the first progress update, so create the indicator early
+        let indicator = activeProgressIndicators.get(progress.transferId);
+        if (!indicator) {
+            indicator = createProgressIndicator({
+                transferId: progress.transferId,
+                filename: progress.filename,
+                bytesSent: 0,
+                totalBytes: progress.totalBytes,
+                percent: 0,
+                speed: 0,
+                timeRemaining: Infinity
+            });
+            activeProgressIndicators.set(progress.transferId, indicator);
+        }
+        
+        const statusElement = indicator.querySelector('[data-role="transfer-status"]');
+        if (statusElement) {
+            statusElement.textContent = text;
+        }
+    };
+    
     fileTransfer.onVerificationStart = () => {
         if (elements.transferStatus) {
             elements.transferStatus.textContent = 'Verifying...';
@@ -943,7 +1429,7 @@ function initUI() {
         // Add to transfer history
         addToHistory({
             type: 'received',
-            filename: fileInfo.name,
+            filename: getDownloadName(fileInfo),
             filesize: formatBytes(fileInfo.size),
             speed: formatBytes(finalSpeed) + '/s',
             downloadUrl: downloadUrl
@@ -953,7 +1439,7 @@ function initUI() {
         try {
             const a = document.createElement('a');
             a.href = downloadUrl;
-            a.download = fileInfo.name;
+            a.download = getDownloadName(fileInfo);
             a.style.display = 'none';
             document.body.appendChild(a);
             a.click();
@@ -999,7 +1485,7 @@ function initUI() {
             // Check if peer token is provided
             if (elements.peerToken.value) {
                 // Connect to peer
-                p2p.connectToPeer(elements.peerToken.value);
+                await p2p.connectToPeer(elements.peerToken.value);
             }
             
             // Re-enable button
@@ -1030,7 +1516,9 @@ function initUI() {
             }
             
             // Connect to peer
-            p2p.connectToPeer(elements.peerToken.value);
+            p2p.connectToPeer(elements.peerToken.value).catch(error => {
+                logger.error('Connection request failed:', error);
+            });
         } else {
             logger.error('Peer token is required');
         }
@@ -1057,6 +1545,35 @@ function initUI() {
         elements.fileInput.click();
     });
     
+    // Folder select button
+    elements.folderSelectButton.addEventListener('click', () => {
+        elements.folderInput.click();
+    });
+    
+    // Folder input change - send the whole directory tree
+    elements.folderInput.addEventListener('change', async () => {
+        const files = Array.from(elements.folderInput.files);
+        elements.folderInput.value = '';
+        
+        if (files.length === 0) {
+            return;
+        }
+        
+        if (!p2p.isConnected()) {
+            logger.error('Not connected to peer');
+            return;
+        }
+        
+        try {
+            elements.sendFileButton.disabled = true;
+            await fileTransfer.sendDirectory(files);
+        } catch (error) {
+            logger.error('Error sending directory:', error);
+        } finally {
+            elements.sendFileButton.disabled = elements.fileInput.files.length === 0;
+        }
+    });
+    
     // File input change
     elements.fileInput.addEventListener('change', () => {
         if (elements.fileInput.files.length > 0) {
@@ -1073,11 +1590,50 @@ function initUI() {
         }
     });
     
-    // Send file button
+    // Rate limit input - applies immediately, including to transfers in progress
+    elements.rateLimitInput.addEventListener('change', () => {
+        const kilobytesPerSecond = Math.max(0, parseInt(elements.rateLimitInput.value, 10) || 0);
+        elements.rateLimitInput.value = kilobytesPerSecond;
+        fileTransfer.setRateLimit(kilobytesPerSecond * 1024);
+    });
+    
+    // Maximum transfer duration - stalled transfers are aborted regardless
+    elements.maxDurationInput.addEventListener('change', () => {
+        const minutes = Math.max(0, parseInt(elements.maxDurationInput.value, 10) || 0);
+        elements.maxDurationInput.value = minutes;
+        fileTransfer.setMaxTransferDuration(minutes * 60 * 1000);
+    });
+    
+    // Receive memory - incoming files are held in memory until saved
+    elements.receiveMemoryInput.addEventListener('change', () => {
+        const megabytes = Math.max(1, parseInt(elements.receiveMemoryInput.value, 10) || 512);
+        elements.receiveMemoryInput.value = megabytes;
+        fileTransfer.setReceiveMemoryLimit(megabytes * 1024 * 1024);
+    });
+    
+    // Incoming file filters
+    const updateBlocklist = () => {
+        fileTransfer.setBlocklist({
+            extensions: elements.blockedExtensionsInput.value.split(','),
+            hashes: elements.blockedHashesInput.value.split(',')
+        });
+    };
+    elements.blockedExtensionsInput.addEventListener('change', updateBlocklist);
+    elements.blockedHashesInput.addEventListener('change', updateBlocklist);
+    
+    // Send file button - queues the file, so more can be added while one is sending
     elements.sendFileButton.addEventListener('click', async () => {
         if (elements.fileInput.files.length > 0) {
             try {
                 const file = elements.fileInput.files[0];
+                const startAt = parseStartTime(elements.sendAtInput.value);
+                const priority = parseInt(elements.sendPriority.value, 10) || 0;
+                
+                // A file that waits leaves the progress display to the one being sent
+                if (startAt || fileTransfer.getSendQueue().length > 0) {
+                    await fileTransfer.enqueueFile(file, { priority, startAt });
+                    return;
+                }
                 
                 // CRITICAL FIX: Reset transfer progress UI for new transfer
                 // Clear any previous transfer state and reset to clean state
@@ -1111,19 +1667,15 @@ function initUI() {
                     elements.cancelTransferButton.classList.remove('hidden');
                 }
                 
-                // Disable send button
-                elements.sendFileButton.disabled = true;
-                
                 // Send file
-                await fileTransfer.sendFile(file);
+                await fileTransfer.enqueueFile(file, { priority, startAt });
             } catch (error) {
                 logger.error('Error sending file:', error);
                 
-                // Hide transfer progress
-                elements.transferProgress.classList.add('hidden');
-                
-                // Re-enable send button
-                elements.sendFileButton.disabled = false;
+                // Hide transfer progress unless other queued files are still going
+                if (fileTransfer.getSendQueue().length === 0) {
+                    elements.transferProgress.classList.add('hidden');
+                }
             }
         }
     });
@@ -1145,11 +1697,18 @@ function initUI() {
         }
     });
     
+    // Let the peer know we're typing
+    elements.chatInput.addEventListener('input', () => {
+        if (elements.chatInput.value && p2p.isConnected()) {
+            p2p.sendTyping();
+        }
+    });
+    
     // Send chat message
     function sendChatMessage() {
         const message = elements.chatInput.value.trim();
         
-        if (message && p2p.isConnected()) {
+        if (message && p2p.isConnected() && p2p.peerChatEnabled) {
             // Send message
             p2p.sendChatMessage(message);
             
@@ -1161,6 +1720,70 @@ function initUI() {
         }
     }
     
+    // Send the snippet textarea as one message
+    elements.sendSnippetButton.addEventListener('click', () => {
+        const content = elements.snippetInput.value;
+        if (!content.trim() || !p2p.isConnected()) {
+            return;
+        }
+        
+        const name = elements.snippetName.value.trim();
+        try {
+            p2p.sendSnippet(content, name);
+        } catch (error) {
+            logger.error('Snippet not sent:', error.message);
+            return;
+        }
+        
+        addSnippetMessage(content, name, true);
+        elements.snippetInput.value = '';
+        elements.snippetName.value = '';
+    });
+    
+    // Add a text snippet to the chat, with copy and save buttons
+    function addSnippetMessage(content, name, sent) {
+        const messageElement = document.createElement('div');
+        messageElement.className = `message ${sent ? 'sent' : 'received'}`;
+        
+        const header = document.createElement('div');
+        header.className = 'flex items-center justify-between text-xs text-gray-600 mb-1';
+        const title = document.createElement('span');
+        title.textContent = name || 'Text snippet';
+        header.appendChild(title);
+        
+        const actions = document.createElement('span');
+        const copyButton = document.createElement('button');
+        copyButton.className = 'ml-2 underline';
+        copyButton.textContent = 'Copy';
+        copyButton.addEventListener('click', () => {
+            navigator.clipboard.writeText(content).catch(error => logger.error('Copy failed:', error));
+        });
+        const saveButton = document.createElement('button');
+        saveButton.className = 'ml-2 underline';
+        saveButton.textContent = 'Save';
+        saveButton.addEventListener('click', () => {
+            const url = URL.createObjectURL(new Blob([content], { type: 'text/plain' }));
+            const a = document.createElement('a');
+            a.href = url;
+            a.download = (name || 'snippet.txt').replace(/[\/\\]/g, '_');
+            document.body.appendChild(a);
+            a.click();
+            setTimeout(() => {
+                document.body.removeChild(a);
+                URL.revokeObjectURL(url);
+            }, 100);
+        });
+        actions.append(copyButton, saveButton);
+        header.appendChild(actions);
+        
+        const pre = document.createElement('pre');
+        pre.textContent = content;
+        
+        messageElement.append(header, pre);
+        elements.chatMessages.appendChild(messageElement);
+        elements.chatMessages.scrollTop = elements.chatMessages.scrollHeight;
+    }
+    
     // Add chat message
     function addChatMessage(message, sent) {
         const messageElement = document.createElement('div');
@@ -1255,6 +1878,32 @@ function initUI() {
         }, 3000);
     }
     
+    // File offer buttons
+    elements.acceptFile.addEventListener('click', () => answerFileOffer(true));
+    elements.declineFile.addEventListener('click', () => answerFileOffer(false));
+    
+    elements.autoAcceptFiles.addEventListener('change', () => {
+        fileTransfer.autoAcceptFiles = elements.autoAcceptFiles.checked;
+    });
+    
+    // Desktop notifications, remembered across visits; needs the browser's permission
+    if (!('Notification' in window)) {
+        elements.desktopNotifications.disabled = true;
+    } else {
+        elements.desktopNotifications.checked = localStorage.getItem('p2pftp.notify') === 'true' &&
+            Notification.permission === 'granted';
+    }
+    elements.desktopNotifications.addEventListener('change', async () => {
+        if (elements.desktopNotifications.checked && Notification.permission !== 'granted') {
+            const permission = await Notification.requestPermission();
+            if (permission !== 'granted') {
+                logger.warn('Desktop notifications were not permitted by the browser');
+                elements.desktopNotifications.checked = false;
+            }
+        }
+        localStorage.setItem('p2pftp.notify', elements.desktopNotifications.checked);
+    });
+    
     // Accept connection button
     elements.acceptConnection.addEventListener('click', () => {
         const peerToken = elements.connectionRequestModal.dataset.peerToken;
@@ -1324,7 +1973,7 @@ function initUI() {
                 // Use the stored download URL from history if available
                 let downloadUrl = null;
                 const historyItem = transferHistory.find(item =>
-                    item.type === 'received' && item.filename === window.receivedFileInfo.name
+                    item.type === 'received' && item.filename === getDownloadName(window.receivedFileInfo)
                 );
                 
                 if (historyItem && historyItem.downloadUrl) {
@@ -1336,7 +1985,7 @@ function initUI() {
                 
                 const a = document.createElement('a');
                 a.href = downloadUrl;
-                a.download = window.receivedFileInfo.name;
+                a.download = getDownloadName(window.receivedFileInfo);
                 a.style.display = 'none';
                 document.body.appendChild(a);
                 a.click();
@@ -1428,7 +2077,15 @@ function initUI() {
         }
         
         // Update P2P connection indicator
-        if (p2p.isConnected()) {
+        if (p2p.isConnected() && p2p.peerUnreachable) {
+            p2pIndicator.className = 'inline-flex items-center px-2 py-1 rounded-full text-xs font-medium bg-yellow-100 text-yellow-800';
+            p2pIndicator.innerHTML = `
+                <svg class="w-3 h-3 mr-1" fill="currentColor" viewBox="0 0 20 20">
+                    <circle cx="10" cy="10" r="3"></circle>
+                </svg>
+                P2P: Peer unreachable
+            `;
+        } else if (p2p.isConnected()) {
             p2pIndicator.className = 'inline-flex items-center px-2 py-1 rounded-full text-xs font-medium bg-green-100 text-green-800';
             p2pIndicator.innerHTML = `
                 <svg class="w-3 h-3 mr-1" fill="currentColor" viewBox="0 0 20 20">
@@ -1436,6 +2093,7 @@ function initUI() {
                 </svg>
                 P2P: Connected
             `;
+            _updatePathIndicator();
         } else {
             p2pIndicator.className = 'inline-flex items-center px-2 py-1 rounded-full text-xs font-medium bg-red-100 text-red-800';
             p2pIndicator.innerHTML = `
@@ -1444,6 +2102,33 @@ function initUI() {
                 </svg>
                 P2P: Not Connected
             `;
+            pathIndicatorKey = null;
+            document.getElementById('path-status-indicator').classList.add('hidden');
+        }
+    }
+    
+    let pathIndicatorKey = null;
+    
+    /**
+     * Show whether the peer connection is direct or relayed, logging changes
+     * @private
+     */
+    async function _updatePathIndicator() {
+        const pathIndicator = document.getElementById('path-status-indicator');
+        const info = await p2p.getConnectionInfo().catch(() => null);
+        if (!info || !p2p.isConnected()) {
+            return;
+        }
+        
+        const colors = info.type === 'relay' ? 'bg-yellow-100 text-yellow-800' : 'bg-green-100 text-green-800';
+        pathIndicator.className = `inline-flex items-center px-2 py-1 rounded-full text-xs font-medium ${colors}`;
+        pathIndicator.textContent = `Path: ${info.label}`;
+        pathIndicator.title = `Local ${info.localAddress} (${info.localType}), remote ${info.remoteAddress} (${info.remoteType}) over ${info.protocol}`;
+        
+        const key = `${info.localAddress}|${info.remoteAddress}`;
+        if (key !== pathIndicatorKey) {
+            pathIndicatorKey = key;
+            logger.log(`Connection path: ${info.label} - ${pathIndicator.title}`);
         }
     }
     
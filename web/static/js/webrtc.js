@@ -23,6 +23,9 @@ class P2PConnection {
         };
         
         this.stunServersLoaded = false;
+        this.localIceServers = this._loadLocalIceServers(); // User-configured STUN/TURN servers, added to the server's list
+        this.pinnedConfigKey = null; // Base64url Ed25519 key the server's ICE config must be signed with
+        this.authToken = null; // Shared secret for servers started with -auth-token
 
         // Channel configuration
         this.controlChannelConfig = {
@@ -50,6 +53,17 @@ class P2PConnection {
         this.DEFAULT_CHUNK_SIZE = 16384;  // 16KB default
         this.MAX_CHUNK_SIZE = 262144; // 256KB maximum
 
+        // Control protocol version we speak; peers that don't report one are version 1
+        this.PROTOCOL_VERSION = 3;
+        // Lowest peer version each feature needs. Features with their own
+        // capability flag are gated by it instead and needn't be listed.
+        this.FEATURE_VERSIONS = {
+            transferPause: 2, // transfer-paused/transfer-resumed while a queued send is held
+            protocolErrors: 2, // protocol-error sent back for invalid control messages
+            transferReport: 3 // transfer-report from the receiver after verification
+        };
+        this.protocolVersion = 1; // Negotiated with the peer's capabilities
+
         // State
         this.peerConnection = null;
         this.signaler = null;
@@ -66,24 +80,124 @@ class P2PConnection {
         this.capabilitiesPromise = null;
         this.capabilitiesResolve = null;
         this.capabilitiesReject = null;
+        this.signaledCapabilities = null; // Peer capabilities that arrived with its offer or answer
+        this.chatEnabled = true; // Set to false for receivers that never display chat
+        this.peerChatEnabled = true;
+        this.chunkChecksums = true; // We support per-chunk CRC32 in the frame header
+        this.chunkChecksumsEnabled = false; // True once both peers advertise support
+        this.compression = typeof CompressionStream !== 'undefined' ? ['gzip'] : []; // Chunk compression formats we support
+        this.compressionFormat = null; // Negotiated chunk compression, null if none
+        this.fileOffers = true; // We ask before accepting files (file-offer / file-accept)
+        this.peerFileOffers = false; // True if the peer waits for file-accept before streaming
+        this.ackDelay = 20; // ms we are willing to coalesce flow-control acks as a receiver
+        this.negotiatedAckDelay = 0; // 0 means acknowledge every chunk immediately
+        this.controlBatching = true; // We accept several control messages in one 'batch' frame
+        this.controlBatchingEnabled = false; // True once both peers advertise support
+        this.controlBatch = []; // Batchable control messages waiting to be flushed
+        this.controlBatchTimer = null;
+        this.maxControlBatch = 32;
+        this.presence = true; // We send and display typing and active/idle notices
+        this.peerPresenceEnabled = false; // True once the peer advertises presence support
+        this.localActive = true; // Whether our user is at the page, as last reported
+        this.peerActive = true;
+        this.peerLastSeen = null; // Time of the peer's last chat or presence message
+        this.typingInterval = 2500; // ms between 'typing' notices while the user types
+        this.typingTimeout = 4000; // ms a peer stays "typing" after its last notice
+        this.lastTypingSent = 0;
+        this.snippets = true; // We display text-snippet messages in the chat
+        this.peerSnippets = false; // True once the peer advertises snippet support
+        this.maxSnippetSize = 64 * 1024; // Bytes of UTF-8 text in one snippet
+        this.heartbeat = true; // We send heartbeats on the control channel
+        this.peerHeartbeat = false; // True once the peer advertises heartbeats
+        this.heartbeatInterval = 5000; // ms between our heartbeats
+        this.heartbeatTimeout = 15000; // ms of silence before the peer counts as unreachable
+        this.heartbeatTimer = null;
+        this.lastHeartbeatTick = 0;
+        this.lastPeerActivity = 0; // Time anything last arrived from the peer
+        this.peerUnreachable = false;
+        this.diagnostics = true; // We answer rtt-ping and take part in speed tests
+        this.peerDiagnostics = false; // True once the peer advertises diagnostics support
+        this.pendingPings = new Map(); // ping id -> { sent, resolve, reject, timer }
+        this.nextPingId = 1;
+        this.speedTestSend = null; // { id, resolve, reject, timer } while our speed test runs
+        this.speedTestReceive = null; // { id, frames, bytes, firstTime, lastTime } while the peer's runs
+        this.protocolViolations = 0; // Malformed control messages received from this peer
+        this.maxProtocolViolations = 5; // Disconnect once the peer sends this many
+        this.encryptionKeyPair = null; // Local X25519 key pair, null if unsupported
+        this.localPublicKey = null;
+        this.encryptionKey = null; // AES-GCM key derived from the X25519 exchange
+        this.encryptionEnabled = false;
+        this.securityCode = null; // Short authentication string for verbal verification
+        this.keyGenerationPromise = null;
+        this.identityKeyPair = null; // Persistent Ed25519 identity, null if unsupported
+        this.identityPublicKey = null;
+        this.identityFingerprint = null;
+        this.identityPromise = null;
+        this.identityProofTimeout = 10000; // How long to wait for the peer's identity proof
+        this.peerIdentity = null; // { publicKey, fingerprint } once the peer proves its identity
+        this.trustedPeers = this._loadTrustedPeers(); // fingerprint -> { name, added }
+        this.autoAcceptPolicy = this._loadAutoAcceptPolicy(); // never, known-peers or all
+        this.expectedPeerFingerprint = null; // Identity a request was auto-accepted for
+        this._resetEncryptionPromise();
+        this._resetIdentityProof();
         this.logger = logger || console;
         this.pendingICECandidates = [];
         this.connectionAccepted = false;
         
+        // Token assignment tracking
+        this.tokenTimeout = 10000; // ms to wait for the server to assign a token
+        this.maxTokenRetries = 3; // Registration attempts before giving up
+        this.signalingFramesReceived = 0;
+        this.lastSignalingClose = null;
+        this.tokenResolve = null;
+        this.tokenReject = null;
+        
+        // Signaling reconnect within the server's grace period
+        this.wsURL = null;
+        this.reconnectSecret = null; // Issued with the token, lets us reclaim it
+        this.reconnectDelay = 2000;
+        this.maxReconnectAttempts = 15; // Stays inside the server's default 60s grace
+        this.reconnecting = false;
+        this.signalingQueue = []; // Messages held until a reconnect finishes, in order
+        this.maxSignalingQueue = 64; // Matches the server's pending queue for a reconnecting client
+        
+        // Signaling keepalive (browsers can't observe WebSocket ping frames)
+        this.keepaliveInterval = 25000;
+        this.keepaliveTimeout = 10000; // Extra time allowed for a pong before the socket is presumed dead
+        this.keepaliveTimer = null;
+        this.lastPong = 0;
+        this.serverAnswersPing = false; // Older servers never answer, so don't time them out
+        
+        // Sleep/resume detection
+        this.sleepCheckInterval = 5000; // How often the watchdog ticks
+        this.sleepGapThreshold = 15000; // A tick this late means the machine was suspended
+        this.sleepWatchdog = null;
+        this.lastSleepCheck = 0;
+        this.iceRestartPending = false;
+        
         // Server disconnection state tracking
         this.serverConnected = false;
         this.p2pConnected = false;
         this.serverDisconnected = false;
+        this.keepSignaler = false; // Server keeps transfer history, which needs the signaler
 
         // Event handlers
         this.onStatusChange = null;
         this.onTokenReceived = null;
         this.onConnectionRequest = null;
         this.onMessage = null;
+        this.onSnippet = null;
         this.onControlMessage = null;
         this.onDataMessage = null;
         this.onError = null;
         this.onPeerDisconnect = null;
+        this.onPeerCapabilities = null;
+        this.onEncryptionReady = null;
+        this.onEncryptionUnavailable = null;
+        this.onPeerIdentity = null;
+        this.onPeerPresence = null;
+        this.onPeerReachability = null;
+        this.onResumeFromSleep = null;
     }
 
     /**
@@ -109,7 +223,15 @@ class P2PConnection {
                 throw new Error(`Failed to fetch config: ${response.status}`);
             }
 
-            const data = await response.json();
+            let data = await response.json();
+            this.keepSignaler = data.history === true;
+            
+            // With a pinned operator key, only trust the signed copy of the ICE servers
+            if (this.pinnedConfigKey) {
+                data = await this._verifySignedConfig(data);
+                this.logger.log('Verified ICE configuration signature');
+            }
+            
             if (data.stunServers && Array.isArray(data.stunServers) && data.stunServers.length > 0) {
                 this.config.iceServers = [
                     {
@@ -119,13 +241,108 @@ class P2PConnection {
                 this.logger.log('Loaded STUN servers from server:', data.stunServers);
             }
             
+            // Add TURN relays so connections can fall back across symmetric NATs
+            if (data.turnServers && Array.isArray(data.turnServers)) {
+                for (const turn of data.turnServers) {
+                    if (!turn.urls || turn.urls.length === 0) {
+                        continue;
+                    }
+                    this.config.iceServers.push({
+                        urls: turn.urls,
+                        username: turn.username,
+                        credential: turn.credential
+                    });
+                    this.logger.log('Loaded TURN servers from server:', turn.urls);
+                }
+            }
+            
+            this._addLocalIceServers();
             this.stunServersLoaded = true;
         } catch (error) {
             this.logger.warn('Failed to fetch STUN servers from server, using defaults:', error);
+            if (this.pinnedConfigKey && this.onError) {
+                this.onError('Server ICE configuration could not be verified, using default STUN servers: ' + error.message);
+            }
+            this._addLocalIceServers();
             this.stunServersLoaded = true;
         }
     }
 
+    /**
+     * Append the user's own ICE servers after the server-provided ones
+     * @private
+     */
+    _addLocalIceServers() {
+        const known = new Set(this.config.iceServers.flatMap(server => [].concat(server.urls)));
+        for (const server of this.localIceServers) {
+            const urls = server.urls.filter(url => !known.has(url));
+            if (urls.length === 0) {
+                continue;
+            }
+            this.config.iceServers.push({ ...server, urls: urls });
+            this.logger.log('Added local ICE servers:', urls);
+        }
+    }
+
+    /**
+     * Load the user's ICE servers from local storage
+     * @returns {Array} - Entries of { urls, username, credential }
+     * @private
+     */
+    _loadLocalIceServers() {
+        try {
+            const servers = JSON.parse(localStorage.getItem('p2pftp.iceServers'));
+            return Array.isArray(servers) ? servers : [];
+        } catch (error) {
+            return [];
+        }
+    }
+
+    /**
+     * Set and remember the user's own STUN/TURN servers. They take effect on
+     * the next connection to the signaling server.
+     * @param {Array} servers - Entries of { urls: [...], username, credential }
+     */
+    setLocalIceServers(servers) {
+        for (const server of servers) {
+            if (!Array.isArray(server.urls) || server.urls.length === 0 ||
+                !server.urls.every(url => /^(stun|turns?):/.test(url))) {
+                throw new Error('ICE server URLs must start with stun:, turn: or turns:');
+            }
+        }
+        this.localIceServers = servers;
+        this.stunServersLoaded = false; // Rebuild the list on the next connect
+        localStorage.setItem('p2pftp.iceServers', JSON.stringify(servers));
+        this.logger.log(`Saved ${servers.length} local ICE server(s)`);
+    }
+
+    /**
+     * Verify the operator signature on the server's ICE configuration
+     * @param {Object} data - The /api/config response
+     * @returns {Promise<Object>} - The signed ICE configuration
+     * @private
+     */
+    async _verifySignedConfig(data) {
+        if (!data.signedConfig || !data.signature) {
+            throw new Error('Server did not sign its configuration');
+        }
+        
+        const keyBytes = this._base64ToBytes(this.pinnedConfigKey.replace(/-/g, '+').replace(/_/g, '/'));
+        const publicKey = await crypto.subtle.importKey('raw', keyBytes, { name: 'Ed25519' }, false, ['verify']);
+        const valid = await crypto.subtle.verify(
+            { name: 'Ed25519' },
+            publicKey,
+            this._base64ToBytes(data.signature),
+            new TextEncoder().encode(data.signedConfig)
+        );
+        
+        if (!valid) {
+            throw new Error('Configuration signature does not match the pinned key');
+        }
+        
+        return JSON.parse(data.signedConfig);
+    }
+
     /**
      * Connect to the signaling server
      * @param {string} serverURL - The URL of the signaling server
@@ -158,78 +375,357 @@ class P2PConnection {
             await this.fetchStunServers(serverURL);
 
             // Convert HTTP/HTTPS URL to WSS URL
-            const wsURL = this._getWebSocketURL(serverURL);
+            let wsURL = this._getWebSocketURL(serverURL);
             
             // Validate that we got a valid WebSocket URL
             if (!wsURL || !wsURL.startsWith('wss://')) {
                 throw new Error('Failed to construct valid WebSocket URL from server URL');
             }
             
-            this.logger.log('Connecting to signaling server:', wsURL);
+            if (this.authToken) {
+                wsURL += `${wsURL.includes('?') ? '&' : '?'}auth=${encodeURIComponent(this.authToken)}`;
+            }
+            
+            this.wsURL = wsURL;
+            
+            // Register with the server, retrying if no token is assigned
+            for (let attempt = 1; attempt <= this.maxTokenRetries; attempt++) {
+                await this._openSignaler(wsURL);
+                
+                try {
+                    await this._waitForToken();
+                    return;
+                } catch (error) {
+                    // Retrying a full server only adds to its load
+                    if (error.code === 'server-full') {
+                        throw error;
+                    }
+                    
+                    const diagnostics = this._getTokenDiagnostics();
+                    this.logger.warn(`No token received (attempt ${attempt}/${this.maxTokenRetries}): ${diagnostics}`);
+                    
+                    if (this.signaler) {
+                        this.signaler.onclose = null;
+                        this.signaler.close();
+                        this.signaler = null;
+                    }
+                    this.serverConnected = false;
+                    
+                    if (attempt === this.maxTokenRetries) {
+                        throw new Error(`Server did not assign a token after ${attempt} attempts (${diagnostics})`);
+                    }
+                    
+                    if (this.onStatusChange) {
+                        this.onStatusChange(`Retrying registration (${attempt + 1}/${this.maxTokenRetries})`);
+                    }
+                }
+            }
+        } catch (error) {
+            this.logger.error('Error connecting to server:', error);
+            if (this.onError) {
+                this.onError('Error connecting to server: ' + error.message);
+            }
+            throw error;
+        }
+    }
 
-            // Create WebSocket connection
-            this.signaler = new WebSocket(wsURL);
+    /**
+     * Open the WebSocket connection to the signaling server
+     * @param {string} wsURL - The WebSocket URL
+     * @returns {Promise} - Resolves when the socket is open
+     * @private
+     */
+    _openSignaler(wsURL) {
+        this.logger.log('Connecting to signaling server:', wsURL);
+        
+        this.signalingFramesReceived = 0;
+        this.lastSignalingClose = null;
+        
+        // Create WebSocket connection
+        this.signaler = new WebSocket(wsURL);
+        
+        this.signaler.onclose = (event) => {
+            this.logger.log('Disconnected from signaling server');
+            this._stopSignalingKeepalive();
+            this.serverConnected = false;
+            this.lastSignalingClose = event;
+            if (this.onStatusChange) {
+                this.onStatusChange('Disconnected from signaling server');
+            }
+            
+            // Unexpected drop: try to reclaim our token before the server forgets it
+            if (!event.wasClean && this.token && this.reconnectSecret && !this.serverDisconnected) {
+                this._reconnectSignaler();
+            }
+        };
+        
+        this.signaler.onmessage = (event) => {
+            this.signalingFramesReceived++;
+            this._handleSignalingMessage(event.data);
+        };
+        
+        // Wait for connection to open
+        return new Promise((resolve, reject) => {
+            const timeout = setTimeout(() => {
+                reject(new Error('Connection to signaling server timed out'));
+            }, 10000);
             
-            // Set up event handlers
             this.signaler.onopen = () => {
+                clearTimeout(timeout);
                 this.logger.log('Connected to signaling server');
                 this.serverConnected = true;
+                this._startSignalingKeepalive();
                 if (this.onStatusChange) {
                     this.onStatusChange('Connected to signaling server');
                 }
+                resolve();
             };
-
-            this.signaler.onclose = () => {
-                this.logger.log('Disconnected from signaling server');
-                this.serverConnected = false;
-                if (this.onStatusChange) {
-                    this.onStatusChange('Disconnected from signaling server');
-                }
-            };
-
+            
             this.signaler.onerror = (error) => {
+                clearTimeout(timeout);
                 this.logger.error('Signaling server error:', error);
+                // Browsers hide the HTTP status of a refused upgrade, so name the likely causes
+                this.logger.warn('The server may require an auth token (?auth=) or be rate limiting connections from this address');
                 if (this.onError) {
                     this.onError('Signaling server error: ' + error);
                 }
+                reject(error);
             };
-
-            this.signaler.onmessage = (event) => {
-                this._handleSignalingMessage(event.data);
-            };
-
-            // Wait for connection to open
-            return new Promise((resolve, reject) => {
-                const timeout = setTimeout(() => {
-                    reject(new Error('Connection to signaling server timed out'));
-                }, 10000);
-
-                this.signaler.onopen = () => {
-                    clearTimeout(timeout);
-                    this.logger.log('Connected to signaling server');
-                    this.serverConnected = true;
-                    if (this.onStatusChange) {
-                        this.onStatusChange('Connected to signaling server');
+        });
+    }
+    
+    /**
+     * Periodically ping the signaling server and detect a dead socket
+     * @private
+     */
+    _startSignalingKeepalive() {
+        this._stopSignalingKeepalive();
+        this.lastPong = Date.now();
+        
+        this.keepaliveTimer = setInterval(() => {
+            if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+                this._stopSignalingKeepalive();
+                return;
+            }
+            
+            const silence = Date.now() - this.lastPong;
+            if (this.serverAnswersPing && silence > this.keepaliveInterval + this.keepaliveTimeout) {
+                this.logger.warn(`No pong from signaling server for ${Math.round(silence / 1000)}s, reconnecting`);
+                this._stopSignalingKeepalive();
+                
+                // The close handshake can't complete on a dead socket, so don't wait for onclose
+                const deadSignaler = this.signaler;
+                deadSignaler.onclose = null;
+                deadSignaler.close();
+                this.signaler = null;
+                this.serverConnected = false;
+                
+                if (this.onStatusChange) {
+                    this.onStatusChange('Signaling connection lost');
+                }
+                
+                if (this.token && this.reconnectSecret && !this.serverDisconnected) {
+                    this._reconnectSignaler();
+                }
+                return;
+            }
+            
+            this.signaler.send(JSON.stringify({ type: 'ping' }));
+        }, this.keepaliveInterval);
+    }
+    
+    /**
+     * Stop the signaling keepalive timer
+     * @private
+     */
+    _stopSignalingKeepalive() {
+        if (this.keepaliveTimer) {
+            clearInterval(this.keepaliveTimer);
+            this.keepaliveTimer = null;
+        }
+    }
+    
+    /**
+     * Reconnect to the signaling server and reclaim our token, or register
+     * anew once the secret has been dropped
+     * @private
+     */
+    async _reconnectSignaler() {
+        if (this.reconnecting) {
+            return;
+        }
+        this.reconnecting = true;
+        
+        const previousToken = this.token;
+        const url = this.reconnectSecret ?
+            `${this.wsURL}${this.wsURL.includes('?') ? '&' : '?'}token=${encodeURIComponent(previousToken)}&secret=${encodeURIComponent(this.reconnectSecret)}` :
+            this.wsURL;
+        
+        try {
+            for (let attempt = 1; attempt <= this.maxReconnectAttempts; attempt++) {
+                await new Promise(resolve => setTimeout(resolve, this.reconnectDelay));
+                
+                this.logger.log(`Reconnecting to signaling server (attempt ${attempt}/${this.maxReconnectAttempts})`);
+                if (this.onStatusChange) {
+                    this.onStatusChange(`Reconnecting to signaling server (${attempt}/${this.maxReconnectAttempts})`);
+                }
+                
+                try {
+                    // Clear the token so we wait for the server to confirm it
+                    this.token = null;
+                    await this._openSignaler(url);
+                    await this._waitForToken();
+                    
+                    if (this.token === previousToken) {
+                        this.logger.log('Reclaimed token after reconnect:', this.token);
+                        this._flushSignalingQueue();
+                    } else {
+                        this.logger.warn(`Token expired during disconnect, new token: ${this.token}`);
+                        this._dropSignalingQueue('our token changed during the reconnect');
                     }
-                    resolve();
-                };
-
-                this.signaler.onerror = (error) => {
-                    clearTimeout(timeout);
-                    this.logger.error('Signaling server error:', error);
-                    if (this.onError) {
-                        this.onError('Signaling server error: ' + error);
+                    return;
+                } catch (error) {
+                    this.token = previousToken;
+                    if (this.signaler) {
+                        this.signaler.onclose = null;
+                        this.signaler.close();
+                        this.signaler = null;
                     }
-                    reject(error);
-                };
-            });
-        } catch (error) {
-            this.logger.error('Error connecting to server:', error);
+                }
+            }
+            
+            this.logger.error('Could not reconnect to signaling server');
+            this._dropSignalingQueue('the signaling server could not be reached');
             if (this.onError) {
-                this.onError('Error connecting to server: ' + error.message);
+                this.onError('Lost connection to signaling server. Please reconnect.');
             }
-            throw error;
+        } finally {
+            this.reconnecting = false;
+        }
+    }
+    
+    /**
+     * Whether a signaling message can be sent now or after the reconnect in progress
+     * @returns {boolean}
+     * @private
+     */
+    _canSignal() {
+        return this.reconnecting || Boolean(this.signaler && this.signaler.readyState === WebSocket.OPEN);
+    }
+
+    /**
+     * Send a signaling message, holding it while a reconnect is in progress so
+     * nothing is lost and order is preserved
+     * @param {Object} message - The signaling message
+     * @private
+     */
+    _sendSignaling(message) {
+        if (!this.reconnecting && this.signalingQueue.length === 0 &&
+            this.signaler && this.signaler.readyState === WebSocket.OPEN) {
+            this.signaler.send(JSON.stringify(message));
+            return;
+        }
+        
+        if (!this.reconnecting) {
+            throw new Error('Not connected to signaling server');
+        }
+        if (this.signalingQueue.length >= this.maxSignalingQueue) {
+            throw new Error(`Signaling queue full (${this.maxSignalingQueue} messages) while reconnecting`);
+        }
+        this.signalingQueue.push(message);
+        this.logger.log(`Queued ${message.type} until the signaling server is back (${this.signalingQueue.length} queued)`);
+    }
+
+    /**
+     * Send the messages held during a reconnect
+     * @private
+     */
+    _flushSignalingQueue() {
+        if (this.signalingQueue.length === 0) {
+            return;
+        }
+        
+        const queued = this.signalingQueue;
+        this.signalingQueue = [];
+        this.logger.log(`Sending ${queued.length} signaling message(s) held during the reconnect`);
+        for (const message of queued) {
+            this.signaler.send(JSON.stringify(message));
+        }
+    }
+
+    /**
+     * Discard messages held during a reconnect that can no longer be delivered
+     * @param {string} reason - Why, for the log and the error callback
+     * @private
+     */
+    _dropSignalingQueue(reason) {
+        if (this.signalingQueue.length === 0) {
+            return;
+        }
+        
+        const types = this.signalingQueue.map(message => message.type).join(', ');
+        this.logger.error(`Dropped ${this.signalingQueue.length} signaling message(s) (${types}): ${reason}`);
+        if (this.onError) {
+            this.onError(`Signaling messages were lost because ${reason}`);
+        }
+        this.signalingQueue = [];
+    }
+
+    /**
+     * Wait for the server to assign a token
+     * @returns {Promise} - Resolves with the token, rejects on timeout
+     * @private
+     */
+    _waitForToken() {
+        if (this.token) {
+            return Promise.resolve(this.token);
+        }
+        
+        return new Promise((resolve, reject) => {
+            const timeout = setTimeout(() => {
+                this.tokenResolve = null;
+                this.tokenReject = null;
+                reject(new Error('Timed out waiting for token'));
+            }, this.tokenTimeout);
+            
+            this.tokenResolve = (token) => {
+                clearTimeout(timeout);
+                this.tokenResolve = null;
+                this.tokenReject = null;
+                resolve(token);
+            };
+            
+            this.tokenReject = (error) => {
+                clearTimeout(timeout);
+                this.tokenResolve = null;
+                this.tokenReject = null;
+                reject(error);
+            };
+        });
+    }
+    
+    /**
+     * Describe the signaling connection state for token assignment failures
+     * @returns {string} - Human-readable diagnostics
+     * @private
+     */
+    _getTokenDiagnostics() {
+        const states = ['connecting', 'open', 'closing', 'closed'];
+        const parts = [
+            `${this.signalingFramesReceived} frame(s) received`,
+            `socket ${this.signaler ? states[this.signaler.readyState] : 'missing'}`
+        ];
+        
+        if (this.lastSignalingClose) {
+            parts.push(`closed with code ${this.lastSignalingClose.code}` +
+                (this.lastSignalingClose.reason ? ` (${this.lastSignalingClose.reason})` : ''));
+        }
+        
+        if (this.signalingFramesReceived === 0) {
+            parts.push('no frames reached the browser - a proxy may be stripping WebSocket traffic');
         }
+        
+        return parts.join(', ');
     }
 
     /**
@@ -258,6 +754,15 @@ class P2PConnection {
                     this.peerConnection.iceConnectionState === 'completed') {
                     this.connected = true;
                     this.p2pConnected = true;
+                    
+                    // ICE restart after a suspend succeeded
+                    if (this.iceRestartPending) {
+                        this.iceRestartPending = false;
+                        this.logger.log('ICE restart completed after resume');
+                        if (this.onResumeFromSleep) {
+                            this.onResumeFromSleep(true);
+                        }
+                    }
                 } else if (this.peerConnection.iceConnectionState === 'failed' ||
                            this.peerConnection.iceConnectionState === 'disconnected' ||
                            this.peerConnection.iceConnectionState === 'closed') {
@@ -300,8 +805,8 @@ class P2PConnection {
      * Send a connection request to a peer
      * @param {string} peerToken - The token of the peer to connect to
      */
-    connectToPeer(peerToken) {
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+    async connectToPeer(peerToken) {
+        if (!this._canSignal()) {
             throw new Error('Not connected to signaling server');
         }
 
@@ -316,8 +821,14 @@ class P2PConnection {
             type: 'connect',
             peerToken: peerToken
         };
+        
+        // Sign the request so a peer can auto-accept it from a known identity
+        const identity = await this._signConnectionRequest(peerToken);
+        if (identity) {
+            message.identity = identity;
+        }
 
-        this.signaler.send(JSON.stringify(message));
+        this._sendSignaling(message);
         this.logger.log('Sent connection request to peer:', peerToken);
         
         if (this.onStatusChange) {
@@ -330,7 +841,7 @@ class P2PConnection {
      * @param {string} peerToken - The token of the peer to accept
      */
     acceptConnection(peerToken) {
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+        if (!this._canSignal()) {
             throw new Error('Not connected to signaling server');
         }
 
@@ -346,7 +857,7 @@ class P2PConnection {
             peerToken: peerToken
         };
 
-        this.signaler.send(JSON.stringify(message));
+        this._sendSignaling(message);
         this.logger.log('Accepted connection from peer:', peerToken);
         
         if (this.onStatusChange) {
@@ -359,7 +870,7 @@ class P2PConnection {
      * @param {string} peerToken - The token of the peer to reject
      */
     rejectConnection(peerToken) {
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+        if (!this._canSignal()) {
             throw new Error('Not connected to signaling server');
         }
 
@@ -372,7 +883,7 @@ class P2PConnection {
             peerToken: peerToken
         };
 
-        this.signaler.send(JSON.stringify(message));
+        this._sendSignaling(message);
         this.logger.log('Rejected connection from peer:', peerToken);
         
         if (this.onStatusChange) {
@@ -389,57 +900,637 @@ class P2PConnection {
             throw new Error('Control channel not open');
         }
 
+        if (!this.peerChatEnabled) {
+            throw new Error('Peer does not accept chat messages');
+        }
+        
+        // The peer drops longer messages as invalid
+        if (content.length > this.maxSnippetSize) {
+            throw new Error('Message is too long; send it as a file instead');
+        }
+
         const message = {
             type: 'message',
             content: content
         };
 
-        this.controlChannel.send(JSON.stringify(message));
+        this.sendControlMessage(message);
+        this.lastTypingSent = 0;
         this.logger.log('Sent chat message:', content);
     }
 
     /**
-     * Send capabilities to the peer
+     * Send a block of text, such as a config file or log excerpt, to show in the peer's chat
+     * @param {string} content - The text, line breaks preserved
+     * @param {string} [name] - Suggested file name if the peer saves it
      */
-    sendCapabilities() {
+    sendSnippet(content, name) {
         if (!this.controlChannel || this.controlChannel.readyState !== 'open') {
-            this.logger.warn('Control channel not open, cannot send capabilities');
-            return;
+            throw new Error('Control channel not open');
         }
-
-        // Create a promise for capabilities exchange
-        this.capabilitiesPromise = new Promise((resolve, reject) => {
-            this.capabilitiesResolve = resolve;
-            this.capabilitiesReject = reject;
-            
-            // Set up 5-second timeout
-            this.capabilitiesExchangeTimeout = setTimeout(() => {
-                this.logger.error('Capabilities exchange timed out after 5 seconds');
-                this.capabilitiesExchanged = false;
-                if (this.capabilitiesReject) {
-                    this.capabilitiesReject(new Error('Capabilities exchange timed out'));
-                }
-            }, 5000);
-        });
-
+        
+        if (!this.peerSnippets) {
+            throw new Error('Peer does not accept text snippets');
+        }
+        
+        const size = new TextEncoder().encode(content).length;
+        if (size > this.maxSnippetSize) {
+            throw new Error(`Snippet is ${size} bytes, the limit is ${this.maxSnippetSize}; send it as a file instead`);
+        }
+        
         const message = {
-            type: 'capabilities',
-            maxChunkSize: this.maxChunkSize
+            type: 'text-snippet',
+            content: content
         };
-
-        this.controlChannel.send(JSON.stringify(message));
-        this.logger.log('Sent capabilities, max chunk size:', this.maxChunkSize);
+        if (name) {
+            message.name = name.slice(0, 255);
+        }
+        
+        this.sendControlMessage(message);
+        this.lastTypingSent = 0;
+        this.logger.log(`Sent text snippet (${size} bytes)`);
     }
 
     /**
-     * Wait for capabilities exchange to complete
-     * @returns {Promise} - Resolves when capabilities are exchanged
+     * Tell the peer our user is typing. Throttled, so it can be called on
+     * every keystroke.
      */
-    waitForCapabilitiesExchange() {
-        if (this.capabilitiesExchanged) {
-            return Promise.resolve();
+    sendTyping() {
+        const now = Date.now();
+        if (!this._canSendPresence() || now - this.lastTypingSent < this.typingInterval) {
+            return;
         }
-        
+        this.lastTypingSent = now;
+        this.queueControlMessage({ type: 'typing' });
+    }
+
+    /**
+     * Report whether our user is at the page. Only changes are sent.
+     * @param {boolean} active - False once the user has gone idle
+     */
+    setPresence(active) {
+        if (active === this.localActive) {
+            return;
+        }
+        this.localActive = active;
+        if (this._canSendPresence()) {
+            this.queueControlMessage({ type: active ? 'peer-active' : 'peer-idle' });
+        }
+    }
+
+    /**
+     * @returns {boolean} - Whether presence notices can be sent to the peer
+     * @private
+     */
+    _canSendPresence() {
+        return this.peerPresenceEnabled && this.controlChannel && this.controlChannel.readyState === 'open';
+    }
+
+    /**
+     * Measure the round-trip time over the control channel
+     * @returns {Promise<number>} - RTT in milliseconds
+     */
+    ping() {
+        if (!this.isConnected() || !this.peerDiagnostics) {
+            return Promise.reject(new Error('Peer does not support diagnostics'));
+        }
+        
+        const id = this.nextPingId++;
+        return new Promise((resolve, reject) => {
+            const timer = setTimeout(() => {
+                this.pendingPings.delete(id);
+                reject(new Error('Ping timed out'));
+            }, 10000);
+            this.pendingPings.set(id, { sent: performance.now(), resolve, reject, timer });
+            this.sendControlMessage({ type: 'rtt-ping', id: id });
+        });
+    }
+
+    /**
+     * Resolve the ping an rtt-pong answers
+     * @param {Object} message - The rtt-pong message
+     * @private
+     */
+    _handlePong(message) {
+        const ping = this.pendingPings.get(message.id);
+        if (!ping) {
+            return;
+        }
+        clearTimeout(ping.timer);
+        this.pendingPings.delete(message.id);
+        ping.resolve(performance.now() - ping.sent);
+    }
+
+    /**
+     * Saturate the data channel with filler chunks and have the peer report
+     * what arrived. Don't run it alongside a file transfer.
+     * @param {number} duration - How long to send, in ms
+     * @returns {Promise<Object>} - Throughput, loss, RTT and the selected candidate pair
+     */
+    async runSpeedTest(duration = 5000) {
+        if (!this.isConnected() || !this.peerDiagnostics) {
+            throw new Error('Peer does not support diagnostics');
+        }
+        if (this.speedTestSend) {
+            throw new Error('A speed test is already running');
+        }
+        
+        const rtt = await this.ping();
+        const id = Date.now();
+        const chunkSize = this.negotiatedChunkSize;
+        const highWater = 4 * 1024 * 1024;
+        const channel = this.dataChannel;
+        
+        this.speedTestSend = { id, resolve: null, reject: null, timer: null };
+        this.sendControlMessage({ type: 'speedtest-start', id: id });
+        this.logger.log(`Speed test: sending ${chunkSize}-byte chunks for ${duration / 1000}s`);
+        
+        const frame = new Uint8Array(8 + chunkSize);
+        const view = new DataView(frame.buffer);
+        let frames = 0;
+        const start = performance.now();
+        try {
+            while (performance.now() - start < duration) {
+                if (channel.readyState !== 'open') {
+                    throw new Error('Data channel closed during speed test');
+                }
+                if (channel.bufferedAmount > highWater) {
+                    await new Promise(resolve => {
+                        const done = () => {
+                            clearTimeout(timer);
+                            channel.removeEventListener('bufferedamountlow', done);
+                            resolve();
+                        };
+                        const timer = setTimeout(done, 50);
+                        channel.addEventListener('bufferedamountlow', done);
+                    });
+                    continue;
+                }
+                view.setUint32(4, frames);
+                channel.send(frame);
+                frames++;
+            }
+        } catch (error) {
+            this.speedTestSend = null;
+            throw error;
+        }
+        if (!this.speedTestSend) {
+            throw new Error('Connection closed during speed test');
+        }
+        
+        const result = new Promise((resolve, reject) => {
+            const test = this.speedTestSend;
+            test.resolve = resolve;
+            test.reject = reject;
+            test.timer = setTimeout(() => {
+                if (this.speedTestSend === test) {
+                    this.speedTestSend = null;
+                    reject(new Error('Peer did not report speed test results'));
+                }
+            }, 15000);
+        });
+        this.sendControlMessage({ type: 'speedtest-end', id: id, frames: frames });
+        
+        const report = await result;
+        const sentBytes = frames * chunkSize;
+        return {
+            rtt: rtt,
+            sentFrames: frames,
+            sentBytes: sentBytes,
+            receivedFrames: report.frames,
+            receivedBytes: report.bytes,
+            duration: report.duration,
+            throughput: report.duration > 0 ? report.bytes / (report.duration / 1000) : 0,
+            loss: frames > 0 ? Math.max(0, frames - report.frames) / frames : 0,
+            candidatePair: await this.getSelectedCandidatePair()
+        };
+    }
+
+    /**
+     * Resolve our speed test with the peer's report
+     * @param {Object} message - The speedtest-result message
+     * @private
+     */
+    _handleSpeedTestResult(message) {
+        if (!this.speedTestSend || this.speedTestSend.id !== message.id || !this.speedTestSend.resolve) {
+            return;
+        }
+        clearTimeout(this.speedTestSend.timer);
+        this.speedTestSend.resolve(message);
+        this.speedTestSend = null;
+    }
+
+    /**
+     * Count a filler chunk from the peer's speed test
+     * @param {ArrayBuffer} data - The frame
+     * @private
+     */
+    _countSpeedTestFrame(data) {
+        const test = this.speedTestReceive;
+        if (!test) {
+            return;
+        }
+        const now = performance.now();
+        if (test.frames === 0) {
+            test.firstTime = now;
+        }
+        test.lastTime = now;
+        test.frames++;
+        test.bytes += data.byteLength - 8;
+    }
+
+    /**
+     * Report what arrived once the sender says it is done. The end marker
+     * travels on the control channel, so give trailing chunks time to land.
+     * @param {Object} message - The speedtest-end message
+     * @private
+     */
+    async _finishSpeedTestReceive(message) {
+        const test = this.speedTestReceive;
+        if (!test || test.id !== message.id) {
+            return;
+        }
+        
+        const deadline = performance.now() + 2000;
+        while (test.frames < message.frames && performance.now() < deadline) {
+            await new Promise(resolve => setTimeout(resolve, 50));
+        }
+        
+        this.speedTestReceive = null;
+        this.sendControlMessage({
+            type: 'speedtest-result',
+            id: test.id,
+            frames: test.frames,
+            bytes: test.bytes,
+            duration: Math.round(test.lastTime - test.firstTime)
+        });
+        this.logger.log(`Speed test from peer: ${test.frames}/${message.frames} chunks received`);
+    }
+
+    /**
+     * Look up the ICE candidate pair the connection is using
+     * @returns {Promise<Object|null>} - Candidate types, addresses and protocol, or null
+     */
+    async getSelectedCandidatePair() {
+        if (!this.peerConnection) {
+            return null;
+        }
+        
+        const stats = await this.peerConnection.getStats();
+        const pair = this._selectedPairReport(stats);
+        if (!pair) {
+            return null;
+        }
+        
+        const local = stats.get(pair.localCandidateId);
+        const remote = stats.get(pair.remoteCandidateId);
+        const address = candidate => candidate ? `${candidate.address || candidate.ip}:${candidate.port}` : null;
+        return {
+            localType: local ? local.candidateType : null,
+            remoteType: remote ? remote.candidateType : null,
+            localAddress: address(local),
+            remoteAddress: address(remote),
+            protocol: local ? local.protocol : null,
+            rtt: typeof pair.currentRoundTripTime === 'number' ? pair.currentRoundTripTime * 1000 : null
+        };
+    }
+
+    /**
+     * Find the candidate pair in use in a getStats() report
+     * @param {RTCStatsReport} stats - The peer connection stats
+     * @returns {Object|null} - The candidate-pair report
+     * @private
+     */
+    _selectedPairReport(stats) {
+        let pair = null;
+        stats.forEach(report => {
+            if (report.type === 'transport' && report.selectedCandidatePairId) {
+                pair = stats.get(report.selectedCandidatePairId);
+            }
+        });
+        // Firefox has no transport stats, but flags the selected pair itself
+        if (!pair) {
+            stats.forEach(report => {
+                if (report.type === 'candidate-pair' && (report.selected || (report.nominated && report.state === 'succeeded'))) {
+                    pair = pair || report;
+                }
+            });
+        }
+        return pair;
+    }
+
+    /**
+     * Collect transport statistics for the peer connection
+     * @returns {Promise<Object|null>} - Bytes and messages on our data channels,
+     * the current RTT and the browser's outgoing bandwidth estimate
+     */
+    async getStats() {
+        if (!this.peerConnection) {
+            return null;
+        }
+        
+        const stats = await this.peerConnection.getStats();
+        const result = {
+            bytesSent: 0,
+            bytesReceived: 0,
+            messagesSent: 0,
+            messagesReceived: 0,
+            rtt: null,
+            availableOutgoingBitrate: null,
+            bufferedAmount: this.dataChannel ? this.dataChannel.bufferedAmount : 0
+        };
+        stats.forEach(report => {
+            if (report.type === 'data-channel') {
+                result.bytesSent += report.bytesSent || 0;
+                result.bytesReceived += report.bytesReceived || 0;
+                result.messagesSent += report.messagesSent || 0;
+                result.messagesReceived += report.messagesReceived || 0;
+            }
+        });
+        
+        const pair = this._selectedPairReport(stats);
+        if (pair) {
+            if (typeof pair.currentRoundTripTime === 'number') {
+                result.rtt = pair.currentRoundTripTime * 1000;
+            }
+            if (typeof pair.availableOutgoingBitrate === 'number') {
+                result.availableOutgoingBitrate = pair.availableOutgoingBitrate;
+            }
+        }
+        return result;
+    }
+
+    /**
+     * Describe how the connection is routed
+     * @returns {Promise<Object|null>} - The selected candidate pair plus its type ('lan', 'stun' or 'relay') and a label
+     */
+    async getConnectionInfo() {
+        const pair = await this.getSelectedCandidatePair();
+        if (!pair) {
+            return null;
+        }
+        
+        let type = 'stun';
+        let label = 'Direct (STUN)';
+        if (pair.localType === 'relay' || pair.remoteType === 'relay') {
+            type = 'relay';
+            label = 'Relayed (TURN)';
+        } else if (pair.localType === 'host' && pair.remoteType === 'host') {
+            type = 'lan';
+            label = 'Direct (LAN)';
+        }
+        return { ...pair, type, label };
+    }
+
+    /**
+     * Record a presence notice or chat message from the peer
+     * @param {string} type - 'typing', 'peer-active', 'peer-idle' or 'message'
+     * @private
+     */
+    _handlePeerPresence(type) {
+        this.peerLastSeen = Date.now();
+        this.peerActive = type !== 'peer-idle';
+        if (this.onPeerPresence) {
+            this.onPeerPresence({
+                active: this.peerActive,
+                typing: type === 'typing',
+                lastSeen: this.peerLastSeen
+            });
+        }
+    }
+
+    /**
+     * Report a finished transfer to the signaling server's optional history.
+     * Only sizes, timing and the outcome are sent; the server hashes tokens.
+     * @param {Object} report - direction, bytes, duration (ms) and success
+     */
+    reportSession(report) {
+        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+            return;
+        }
+        if (!this.peerToken) {
+            return;
+        }
+        this.signaler.send(JSON.stringify({ type: 'session-report', peerToken: this.peerToken, report: report }));
+    }
+
+    /**
+     * Send a control message now, after anything already queued for batching
+     * @param {Object} message - The control message
+     */
+    sendControlMessage(message) {
+        this.flushControlBatch();
+        this.controlChannel.send(JSON.stringify(message));
+    }
+
+    /**
+     * Queue a small, frequent control message (acks, progress) to be sent
+     * with others from the same burst in a single frame
+     * @param {Object} message - The control message
+     */
+    queueControlMessage(message) {
+        if (!this.controlBatchingEnabled) {
+            this.controlChannel.send(JSON.stringify(message));
+            return;
+        }
+        
+        this.controlBatch.push(message);
+        if (this.controlBatch.length >= this.maxControlBatch) {
+            this.flushControlBatch();
+        } else if (!this.controlBatchTimer) {
+            this.controlBatchTimer = setTimeout(() => this.flushControlBatch(), 0);
+        }
+    }
+
+    /**
+     * Send any queued control messages, as one 'batch' frame if there are several
+     */
+    flushControlBatch() {
+        if (this.controlBatchTimer) {
+            clearTimeout(this.controlBatchTimer);
+            this.controlBatchTimer = null;
+        }
+        if (this.controlBatch.length === 0) {
+            return;
+        }
+        
+        const messages = this.controlBatch;
+        this.controlBatch = [];
+        
+        if (!this.controlChannel || this.controlChannel.readyState !== 'open') {
+            this.logger.warn(`Dropping ${messages.length} batched control messages - control channel not open`);
+            return;
+        }
+        
+        if (messages.length === 1) {
+            this.controlChannel.send(JSON.stringify(messages[0]));
+        } else {
+            this.controlChannel.send(JSON.stringify({ type: 'batch', messages: messages }));
+        }
+    }
+
+    /**
+     * Generate the keys our capabilities advertise
+     * @returns {Promise} - Resolves once the encryption and identity keys are ready
+     * @private
+     */
+    _prepareCapabilities() {
+        return this._prepareEncryption().then(() => this._prepareIdentity());
+    }
+
+    /**
+     * Build the capabilities we advertise, sent over the control channel or
+     * attached to our offer/answer
+     * @returns {Object} - The capabilities message
+     * @private
+     */
+    _buildCapabilities() {
+        const message = {
+            type: 'capabilities',
+            protocolVersion: this.PROTOCOL_VERSION,
+            maxChunkSize: this.maxChunkSize,
+            chat: this.chatEnabled,
+            chunkChecksums: this.chunkChecksums,
+            compression: this.compression,
+            ackDelay: this.ackDelay,
+            fileOffers: this.fileOffers,
+            controlBatching: this.controlBatching,
+            presence: this.presence && this.chatEnabled,
+            snippets: this.snippets && this.chatEnabled,
+            heartbeat: this.heartbeat,
+            diagnostics: this.diagnostics
+        };
+        
+        if (this.localPublicKey) {
+            message.publicKey = this.localPublicKey;
+        }
+        
+        // Announce the identity; it is proven with an identity-proof message
+        // once both encryption keys are known
+        if (this.identityKeyPair && this.localPublicKey) {
+            message.identityKey = this.identityPublicKey;
+        }
+        
+        return message;
+    }
+
+    /**
+     * Remember capabilities attached to the peer's offer or answer
+     * @param {Object} message - The signaling message
+     * @private
+     */
+    _storeSignaledCapabilities(message) {
+        if (!message.capabilities || typeof message.capabilities !== 'object') {
+            return;
+        }
+        
+        // Bad signaled capabilities fall back to the control channel exchange
+        const problem = this._validateControlMessage({ ...message.capabilities, type: 'capabilities' });
+        if (problem) {
+            this.logger.warn('Ignoring signaled capabilities:', problem);
+            return;
+        }
+        this.signaledCapabilities = message.capabilities;
+    }
+
+    /**
+     * Apply the capabilities both peers exchanged during signaling, skipping
+     * the round trip over the control channel
+     * @private
+     */
+    _useSignaledCapabilities() {
+        this.logger.log('Using capabilities exchanged with the offer/answer');
+        this.capabilitiesPromise = Promise.resolve();
+        this._handleCapabilities(this.signaledCapabilities);
+    }
+
+    /**
+     * Check whether the negotiated protocol version covers a feature
+     * @param {string} feature - A key of FEATURE_VERSIONS
+     * @returns {boolean} - True if the peer understands the feature
+     */
+    peerSupports(feature) {
+        return this.protocolVersion >= (this.FEATURE_VERSIONS[feature] || 1);
+    }
+
+    /**
+     * Send capabilities to the peer
+     */
+    sendCapabilities() {
+        if (!this.controlChannel || this.controlChannel.readyState !== 'open') {
+            this.logger.warn('Control channel not open, cannot send capabilities');
+            return;
+        }
+
+        // Create a promise for capabilities exchange
+        this.capabilitiesPromise = new Promise((resolve, reject) => {
+            this.capabilitiesResolve = resolve;
+            this.capabilitiesReject = reject;
+            
+            // Set up 5-second timeout
+            this.capabilitiesExchangeTimeout = setTimeout(() => {
+                this.logger.error('Capabilities exchange timed out after 5 seconds');
+                this.capabilitiesExchanged = false;
+                this.encryptionResolve();
+                if (this.capabilitiesReject) {
+                    this.capabilitiesReject(new Error('Capabilities exchange timed out'));
+                }
+            }, 5000);
+        });
+
+        const message = this._buildCapabilities();
+
+        this.controlChannel.send(JSON.stringify(message));
+        this.logger.log('Sent capabilities, max chunk size:', this.maxChunkSize, 'chat:', this.chatEnabled);
+    }
+
+    /**
+     * Wait for the payload encryption key to be derived (if negotiated)
+     * @returns {Promise} - Resolves when encryption is ready or not in use
+     */
+    waitForEncryption() {
+        return this.encryptionPromise;
+    }
+
+    /**
+     * Encrypt a chunk payload
+     * @param {Uint8Array} payload - The plaintext payload
+     * @param {number} transferId - The numeric transfer ID
+     * @param {number} sequence - The chunk sequence number
+     * @returns {Promise<ArrayBuffer>} - The ciphertext (with authentication tag)
+     */
+    encryptChunk(payload, transferId, sequence) {
+        return crypto.subtle.encrypt(
+            { name: 'AES-GCM', iv: this._getChunkNonce(this.isInitiator, transferId, sequence) },
+            this.encryptionKey,
+            payload
+        );
+    }
+
+    /**
+     * Decrypt a chunk payload received from the peer
+     * @param {Uint8Array} payload - The ciphertext payload
+     * @param {number} transferId - The numeric transfer ID
+     * @param {number} sequence - The chunk sequence number
+     * @returns {Promise<ArrayBuffer>} - The plaintext
+     */
+    decryptChunk(payload, transferId, sequence) {
+        return crypto.subtle.decrypt(
+            { name: 'AES-GCM', iv: this._getChunkNonce(!this.isInitiator, transferId, sequence) },
+            this.encryptionKey,
+            payload
+        );
+    }
+
+    /**
+     * Wait for capabilities exchange to complete
+     * @returns {Promise} - Resolves when capabilities are exchanged
+     */
+    waitForCapabilitiesExchange() {
+        if (this.capabilitiesExchanged) {
+            return Promise.resolve();
+        }
+        
         if (!this.capabilitiesPromise) {
             return Promise.reject(new Error('Capabilities exchange not initiated'));
         }
@@ -493,7 +1584,8 @@ class P2PConnection {
      * @returns {boolean} - True if can disconnect, false otherwise
      */
     canDisconnectFromServer() {
-        return this.isServerConnected() &&
+        return !this.keepSignaler &&
+               this.isServerConnected() &&
                this.isConnected() &&
                this.capabilitiesExchanged &&
                !this.serverDisconnected;
@@ -512,6 +1604,8 @@ class P2PConnection {
         try {
             this.logger.log('Disconnecting from signaling server - P2P connection is stable');
             
+            this._stopSignalingKeepalive();
+            
             // Close WebSocket connection gracefully
             if (this.signaler && this.signaler.readyState === WebSocket.OPEN) {
                 this.signaler.close(1000, 'P2P connection established');
@@ -548,6 +1642,10 @@ class P2PConnection {
             this.capabilitiesExchangeTimeout = null;
         }
         
+        this._stopSleepWatchdog();
+        this._stopSignalingKeepalive();
+        this._stopHeartbeat();
+        
         // Close data channels
         if (this.controlChannel) {
             this.controlChannel.close();
@@ -572,6 +1670,49 @@ class P2PConnection {
         this.isInitiator = false;
         this.capabilitiesExchanged = false;
         this.connectionAccepted = false;
+        this.iceRestartPending = false;
+        this.peerChatEnabled = true;
+        this.chunkChecksumsEnabled = false;
+        this.compressionFormat = null;
+        this.negotiatedAckDelay = 0;
+        this.peerFileOffers = false;
+        this.controlBatchingEnabled = false;
+        this.controlBatch = [];
+        if (this.controlBatchTimer) {
+            clearTimeout(this.controlBatchTimer);
+            this.controlBatchTimer = null;
+        }
+        this.encryptionKey = null;
+        this.encryptionEnabled = false;
+        this.securityCode = null;
+        this.peerIdentity = null;
+        this._resetIdentityProof();
+        this.expectedPeerFingerprint = null;
+        this.peerPresenceEnabled = false;
+        this.peerActive = true;
+        this.peerLastSeen = null;
+        this.peerDiagnostics = false;
+        this.peerSnippets = false;
+        this.peerHeartbeat = false;
+        this.protocolVersion = 1;
+        this.peerUnreachable = false;
+        this.signaledCapabilities = null;
+        this.signalingQueue = [];
+        this.protocolViolations = 0;
+        for (const ping of this.pendingPings.values()) {
+            clearTimeout(ping.timer);
+            ping.reject(new Error('Connection closed'));
+        }
+        this.pendingPings.clear();
+        if (this.speedTestSend) {
+            clearTimeout(this.speedTestSend.timer);
+            if (this.speedTestSend.reject) {
+                this.speedTestSend.reject(new Error('Connection closed'));
+            }
+            this.speedTestSend = null;
+        }
+        this.speedTestReceive = null;
+        this._resetEncryptionPromise();
         this.capabilitiesPromise = null;
         this.capabilitiesResolve = null;
         this.capabilitiesReject = null;
@@ -647,8 +1788,18 @@ class P2PConnection {
                 this.onStatusChange('Control channel opened');
             }
             
-            // Send capabilities after channel is open
-            this.sendCapabilities();
+            // A peer that sent capabilities with its offer/answer also got ours, so
+            // there is nothing left to exchange; otherwise send them (including our
+            // public key and identity) now that the channel is open
+            this._prepareCapabilities().then(() => {
+                if (this.signaledCapabilities) {
+                    this._useSignaledCapabilities();
+                } else {
+                    this.sendCapabilities();
+                }
+            });
+            
+            this._startSleepWatchdog();
         };
 
         channel.onclose = () => {
@@ -677,6 +1828,7 @@ class P2PConnection {
             try {
                 // Try to parse as JSON
                 if (typeof data === 'string') {
+                    this._notePeerActivity();
                     const jsonData = JSON.parse(data);
                     this.logger.log('Received control message:', jsonData.type);
                     
@@ -685,25 +1837,19 @@ class P2PConnection {
                         this.logger.log('DEBUG: Received flow-control-ack:', jsonData);
                     }
                     
-                    // Handle specific message types
-                    switch (jsonData.type) {
-                        case 'message':
-                            if (this.onMessage) {
-                                this.onMessage(jsonData.content);
-                            }
-                            break;
-                        case 'capabilities':
-                            this._handleCapabilities(jsonData);
-                            break;
-                        case 'capabilities-ack':
-                            this._handleCapabilitiesAck(jsonData);
-                            break;
-                        default:
-                            // Pass to general control handler
-                            if (this.onControlMessage) {
-                                this.onControlMessage(jsonData);
+                    if (!this._checkControlMessage(jsonData)) {
+                        return;
+                    }
+                    
+                    if (jsonData.type === 'batch') {
+                        // Unpack in order; batches don't nest
+                        for (const message of jsonData.messages) {
+                            if (message.type !== 'batch' && this._checkControlMessage(message)) {
+                                this._dispatchControlMessage(message);
                             }
-                            break;
+                        }
+                    } else {
+                        this._dispatchControlMessage(jsonData);
                     }
                 } else {
                     // Binary data on control channel
@@ -723,132 +1869,881 @@ class P2PConnection {
     }
 
     /**
-     * Set up the data channel
-     * @param {RTCDataChannel} channel - The data channel
+     * Validate an inbound control message, telling the peer about a bad one
+     * and disconnecting after repeated violations
+     * @param {Object} message - The parsed control message
+     * @returns {boolean} - Whether the message may be dispatched
+     * @private
+     */
+    _checkControlMessage(message) {
+        const problem = this._validateControlMessage(message);
+        if (!problem) {
+            return true;
+        }
+        
+        const messageType = message && typeof message.type === 'string' ? message.type.slice(0, 64) : 'unknown';
+        this.protocolViolations++;
+        this.logger.warn(`Dropping invalid ${messageType} message from peer (${this.protocolViolations}/${this.maxProtocolViolations}): ${problem}`);
+        if (this.peerSupports('protocolErrors')) {
+            this.sendControlMessage({
+                type: 'protocol-error',
+                code: 'invalid-message',
+                messageType: messageType,
+                reason: problem
+            });
+        }
+        
+        if (this.protocolViolations >= this.maxProtocolViolations) {
+            this.logger.error('Peer keeps sending invalid control messages, disconnecting');
+            if (this.onError) {
+                this.onError('Disconnected: the peer sent too many invalid protocol messages');
+            }
+            this.close();
+        }
+        return false;
+    }
+
+    /**
+     * Check an inbound control message's field types and bounds. Unknown
+     * types and extra fields pass, so newer peers can extend the protocol.
+     * @param {Object} message - The parsed control message
+     * @returns {string|null} - Why the message is invalid, or null if it's fine
+     * @private
+     */
+    _validateControlMessage(message) {
+        if (!message || typeof message !== 'object' || Array.isArray(message)) {
+            return 'not an object';
+        }
+        if (typeof message.type !== 'string' || message.type === '' || message.type.length > 64) {
+            return 'missing or invalid type';
+        }
+        
+        const integer = (min, max) => value => Number.isInteger(value) && value >= min && value <= max;
+        const string = max => value => typeof value === 'string' && value.length <= max;
+        const list = (max, item) => value => Array.isArray(value) && value.length <= max && value.every(item);
+        const optional = check => value => value === undefined || value === null || check(value);
+        const object = value => Boolean(value) && typeof value === 'object' && !Array.isArray(value);
+        
+        const count = integer(0, Number.MAX_SAFE_INTEGER);
+        const sequence = integer(0, 0xFFFFFFFF); // Chunk frames carry a 32-bit sequence
+        const chunkSize = integer(this.MIN_CHUNK_SIZE, this.MAX_CHUNK_SIZE);
+        const transferId = string(64);
+        const reason = optional(string(1024));
+        const fileInfo = value => object(value) &&
+            string(1024)(value.name) && optional(string(3072))(value.nameEncoded) &&
+            optional(string(4096))(value.path) && optional(string(12288))(value.pathEncoded) &&
+            count(value.size) && optional(string(128))(value.md5);
+        
+        const rules = {
+            'batch': { messages: list(1000, object) },
+            'message': { content: string(this.maxSnippetSize) },
+            'text-snippet': { content: string(this.maxSnippetSize), name: optional(string(255)) },
+            'rtt-ping': { id: count },
+            'rtt-pong': { id: count },
+            'speedtest-start': { id: count },
+            'speedtest-end': { id: count, frames: count },
+            'speedtest-result': { id: count, frames: count, bytes: count, duration: count },
+            'capabilities': { protocolVersion: optional(integer(1, 0xFFFF)), maxChunkSize: optional(chunkSize) },
+            'capabilities-ack': { negotiatedChunkSize: optional(chunkSize) },
+            'identity-proof': { signature: string(128) },
+            'protocol-error': { messageType: string(64), reason: string(1024) },
+            'dir-info': { dirId: string(64), name: string(1024), totalSize: count, files: list(100000, object) },
+            'file-info': { transferId: optional(transferId), info: fileInfo },
+            'file-offer': { transferId: transferId, info: fileInfo, dirId: optional(string(64)) },
+            'file-accept': { transferId: transferId },
+            'file-rejected': { transferId: transferId, code: optional(string(64)), reason: reason },
+            'file-changed': { transferId: transferId, reason: reason },
+            'progress-update': { transferId: optional(transferId), bytesReceived: count, highestSequence: optional(sequence) },
+            'flow-control-ack': { transferId: optional(transferId), highestSequence: integer(-1, 0xFFFFFFFF) },
+            'chunk-request': { transferId: transferId, sequences: list(1024, sequence) },
+            'file-complete': { transferId: optional(transferId) },
+            'file-verified': { transferId: optional(transferId) },
+            'file-failed': { transferId: optional(transferId), reason: reason },
+            'transfer-cancelled': { transferId: optional(transferId) },
+            'transfer-paused': { transferId: transferId },
+            'transfer-resumed': { transferId: transferId },
+            'transfer-report': {
+                transferId: transferId, bytes: count, duplicateChunks: count, requestedChunks: count,
+                duration: count, md5: optional(string(128))
+            }
+        };
+        
+        const fields = rules[message.type];
+        if (!fields) {
+            return null;
+        }
+        for (const [field, check] of Object.entries(fields)) {
+            if (!check(message[field])) {
+                return `invalid ${field}`;
+            }
+        }
+        return null;
+    }
+
+    /**
+     * Route a parsed control message to its handler
+     * @param {Object} jsonData - The control message
+     * @private
+     */
+    _dispatchControlMessage(jsonData) {
+        switch (jsonData.type) {
+            case 'message':
+                if (!this.chatEnabled) {
+                    this.logger.debug('Ignoring chat message - chat disabled');
+                    break;
+                }
+                if (this.onMessage) {
+                    this.onMessage(jsonData.content);
+                }
+                if (this.peerPresenceEnabled) {
+                    this._handlePeerPresence('message');
+                }
+                break;
+            case 'text-snippet':
+                if (!this.snippets || !this.chatEnabled || typeof jsonData.content !== 'string') {
+                    this.logger.debug('Ignoring text snippet');
+                    break;
+                }
+                if (this.onSnippet) {
+                    this.onSnippet({
+                        content: jsonData.content.slice(0, this.maxSnippetSize),
+                        name: typeof jsonData.name === 'string' ? jsonData.name : ''
+                    });
+                }
+                if (this.peerPresenceEnabled) {
+                    this._handlePeerPresence('message');
+                }
+                break;
+            case 'heartbeat':
+                // Arrival alone counts as activity
+                break;
+            case 'protocol-error':
+                this.logger.warn(`Peer rejected our ${jsonData.messageType} message: ${jsonData.reason}`);
+                break;
+            case 'rtt-ping':
+                if (this.diagnostics) {
+                    this.sendControlMessage({ type: 'rtt-pong', id: jsonData.id });
+                }
+                break;
+            case 'rtt-pong':
+                this._handlePong(jsonData);
+                break;
+            case 'speedtest-start':
+                if (this.diagnostics) {
+                    this.speedTestReceive = { id: jsonData.id, frames: 0, bytes: 0, firstTime: 0, lastTime: 0 };
+                }
+                break;
+            case 'speedtest-end':
+                this._finishSpeedTestReceive(jsonData);
+                break;
+            case 'speedtest-result':
+                this._handleSpeedTestResult(jsonData);
+                break;
+            case 'typing':
+            case 'peer-active':
+            case 'peer-idle':
+                if (this.presence && this.chatEnabled) {
+                    this._handlePeerPresence(jsonData.type);
+                }
+                break;
+            case 'capabilities':
+                this._handleCapabilities(jsonData);
+                break;
+            case 'capabilities-ack':
+                this._handleCapabilitiesAck(jsonData);
+                break;
+            case 'identity-proof':
+                this.peerProofResolve(jsonData.signature);
+                break;
+            default:
+                // Pass to general control handler
+                if (this.onControlMessage) {
+                    this.onControlMessage(jsonData);
+                }
+                break;
+        }
+    }
+
+    /**
+     * Set up the data channel
+     * @param {RTCDataChannel} channel - The data channel
+     * @private
+     */
+    _setupDataChannel(channel) {
+        // Set binary type to arraybuffer
+        channel.binaryType = 'arraybuffer';
+
+        channel.onopen = () => {
+            this.logger.log('Data channel opened');
+            if (this.onStatusChange) {
+                this.onStatusChange('Data channel opened');
+            }
+            
+            // Send a test message to verify the channel is working
+            const testData = new Uint8Array([0, 0, 0, 0, 0, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8]);
+            try {
+                channel.send(testData);
+                this.logger.log('Test message sent successfully');
+            } catch (error) {
+                this.logger.error('Failed to send test message:', error);
+            }
+        };
+
+        channel.onclose = () => {
+            this.logger.log('Data channel closed');
+            if (this.onStatusChange) {
+                this.onStatusChange('Data channel closed');
+            }
+            
+            // Trigger peer disconnect event if we were connected
+            if (this.connected && this.onPeerDisconnect) {
+                this.connected = false;
+                this.onPeerDisconnect();
+            }
+        };
+
+        channel.onerror = (error) => {
+            this.logger.error('Data channel error:', error);
+            if (this.onError) {
+                this.onError('Data channel error: ' + error.message);
+            }
+        };
+
+        channel.onmessage = (event) => {
+            const data = event.data;
+            
+            if (data instanceof ArrayBuffer) {
+                this._notePeerActivity();
+                
+                // Transfer ID 0 is reserved for speed test filler
+                if (this.diagnostics && data.byteLength >= 8 && new DataView(data).getUint32(0) === 0) {
+                    this._countSpeedTestFrame(data);
+                    return;
+                }
+                
+                this.logger.log(`Received binary data: ${data.byteLength} bytes`);
+                
+                // Extract transfer ID, sequence number and size if possible
+                if (data.byteLength >= 12) {
+                    const view = new DataView(data);
+                    const transferId = view.getUint32(0);
+                    const sequence = view.getUint32(4);
+                    const chunkSize = view.getUint32(8);
+                    this.logger.log(`Data appears to be chunk ${sequence} for transfer ${transferId} with size ${chunkSize}`);
+                } else if (data.byteLength >= 8) {
+                    // Legacy format without transfer ID
+                    const view = new DataView(data);
+                    const sequence = view.getUint32(0);
+                    const chunkSize = view.getUint32(4);
+                    this.logger.log(`Data appears to be legacy chunk ${sequence} with size ${chunkSize}`);
+                }
+                
+                // Pass to data handler
+                if (this.onDataMessage) {
+                    this.onDataMessage(data);
+                }
+            } else {
+                this.logger.warn('Received non-binary data on data channel:', data);
+                // Still try to pass to data handler
+                if (this.onDataMessage) {
+                    this.onDataMessage(data);
+                }
+            }
+        };
+    }
+
+    /**
+     * Handle capabilities message from peer
+     * @param {Object} capabilities - The capabilities message
+     * @private
+     */
+    _handleCapabilities(capabilities) {
+        const peerMaxChunkSize = capabilities.maxChunkSize || this.DEFAULT_CHUNK_SIZE;
+        
+        this.logger.log('Received capabilities from peer, max chunk size:', peerMaxChunkSize);
+        
+        // Speak the older of the two protocol versions
+        const peerVersion = capabilities.protocolVersion || 1;
+        this.protocolVersion = Math.min(this.PROTOCOL_VERSION, peerVersion);
+        if (peerVersion < this.PROTOCOL_VERSION) {
+            const disabled = Object.keys(this.FEATURE_VERSIONS).filter(feature => !this.peerSupports(feature));
+            this.logger.log(`Peer speaks protocol version ${peerVersion}, disabling:`, disabled.join(', ') || 'nothing');
+        }
+        
+        // Peers that omit the flag predate it and always display chat
+        this.peerChatEnabled = capabilities.chat !== false;
+        if (!this.peerChatEnabled) {
+            this.logger.log('Peer does not display chat messages');
+        }
+        
+        // Per-chunk checksums change the frame header, so both sides must support them
+        this.chunkChecksumsEnabled = this.chunkChecksums && capabilities.chunkChecksums === true;
+        this.logger.log('Per-chunk checksums:', this.chunkChecksumsEnabled ? 'enabled' : 'disabled');
+        
+        // Compression adds a flags byte to the frame header, so it also needs both sides
+        const peerCompression = Array.isArray(capabilities.compression) ? capabilities.compression : [];
+        this.compressionFormat = this.compression.find(format => peerCompression.includes(format)) || null;
+        this.logger.log('Chunk compression:', this.compressionFormat || 'disabled');
+        
+        // Only offer files to peers that will answer the offer
+        this.peerFileOffers = capabilities.fileOffers === true;
+        
+        // Delayed acks: use the smaller interval, and none if the peer doesn't know about them
+        this.negotiatedAckDelay = typeof capabilities.ackDelay === 'number'
+            ? Math.max(0, Math.min(this.ackDelay, capabilities.ackDelay))
+            : 0;
+        this.logger.log('Delayed ack interval:', this.negotiatedAckDelay, 'ms');
+        
+        this.controlBatchingEnabled = this.controlBatching && capabilities.controlBatching === true;
+        this.logger.log('Control message batching:', this.controlBatchingEnabled ? 'enabled' : 'disabled');
+        
+        this.peerDiagnostics = this.diagnostics && capabilities.diagnostics === true;
+        this.peerSnippets = capabilities.snippets === true;
+        
+        // Only expect heartbeats from a peer that sends them
+        this.peerHeartbeat = this.heartbeat && capabilities.heartbeat === true;
+        if (this.peerHeartbeat) {
+            this._startHeartbeat();
+        }
+        
+        // Presence is chat decoration, so skip it if we don't display chat
+        this.peerPresenceEnabled = this.presence && this.chatEnabled && capabilities.presence === true;
+        if (this.peerPresenceEnabled && !this.localActive) {
+            this.queueControlMessage({ type: 'peer-idle' });
+        }
+        
+        // Derive the payload key if both peers offered a public key
+        this._prepareEncryption().then(async () => {
+            if (this.localPublicKey && capabilities.publicKey) {
+                await this._deriveEncryptionKey(capabilities.publicKey);
+            } else {
+                this.logger.warn('Payload encryption not negotiated - relying on DTLS only');
+            }
+            if (!this.encryptionEnabled && this.onEncryptionUnavailable) {
+                this.onEncryptionUnavailable();
+            }
+            
+            // Identities sign this session's keys and tokens, so they only count
+            // once the payload key is derived from those keys
+            if (this.encryptionEnabled && typeof capabilities.identityKey === 'string') {
+                await this._sendIdentityProof(capabilities.publicKey);
+                await this._verifyPeerIdentity(capabilities.identityKey, capabilities.publicKey);
+            }
+            
+            // A request auto-accepted for a known peer must come from that peer
+            const expected = this.expectedPeerFingerprint;
+            if (expected && (!this.encryptionEnabled || !this.peerIdentity || this.peerIdentity.fingerprint !== expected)) {
+                this.logger.error(`Auto-accepted peer did not prove identity ${expected}, disconnecting`);
+                if (this.onError) {
+                    this.onError('Peer did not prove the identity it requested the connection with');
+                }
+                this.close();
+                return;
+            }
+            this.encryptionResolve();
+        });
+        
+        if (this.onPeerCapabilities) {
+            this.onPeerCapabilities(capabilities);
+        }
+        
+        // Negotiate chunk size (minimum of both peers)
+        const negotiatedSize = Math.min(this.maxChunkSize, peerMaxChunkSize);
+        
+        // Log if peer supports larger chunks than our maximum
+        if (peerMaxChunkSize > this.maxChunkSize) {
+            this.logger.log('Peer supports larger chunks than our maximum. Consider increasing our limit for better performance.');
+        }
+        
+        // Update negotiated chunk size
+        this.negotiatedChunkSize = negotiatedSize;
+        
+        // Send acknowledgment
+        this.sendCapabilitiesAck(negotiatedSize);
+        
+        // Mark capabilities as exchanged
+        this.capabilitiesExchanged = true;
+        
+        // Clear timeout and resolve promise
+        if (this.capabilitiesExchangeTimeout) {
+            clearTimeout(this.capabilitiesExchangeTimeout);
+            this.capabilitiesExchangeTimeout = null;
+        }
+        
+        if (this.capabilitiesResolve) {
+            this.capabilitiesResolve();
+            this.capabilitiesResolve = null;
+            this.capabilitiesReject = null;
+        }
+        
+        this.logger.log('Negotiated chunk size:', negotiatedSize);
+        
+        if (this.onStatusChange) {
+            this.onStatusChange('Negotiated chunk size: ' + negotiatedSize + ' bytes');
+        }
+        
+        // Check for P2P stability and trigger disconnection
+        this._checkAndDisconnectFromServer();
+    }
+
+    /**
+     * Generate our X25519 key pair for payload encryption
+     * @returns {Promise} - Resolves once the key pair is ready (or unsupported)
+     * @private
+     */
+    _prepareEncryption() {
+        if (!this.keyGenerationPromise) {
+            this.keyGenerationPromise = (async () => {
+                try {
+                    this.encryptionKeyPair = await crypto.subtle.generateKey({ name: 'X25519' }, true, ['deriveBits']);
+                    const rawPublicKey = await crypto.subtle.exportKey('raw', this.encryptionKeyPair.publicKey);
+                    this.localPublicKey = this._bytesToBase64(new Uint8Array(rawPublicKey));
+                } catch (error) {
+                    this.logger.warn('X25519 not supported by this browser, payload encryption disabled:', error);
+                    this.encryptionKeyPair = null;
+                    this.localPublicKey = null;
+                }
+            })();
+        }
+        return this.keyGenerationPromise;
+    }
+
+    /**
+     * Load (or create and store) our persistent Ed25519 identity
+     * @returns {Promise} - Resolves once the identity is ready (or unsupported)
+     * @private
+     */
+    _prepareIdentity() {
+        if (!this.identityPromise) {
+            this.identityPromise = (async () => {
+                try {
+                    let keyPair = await this._loadIdentityKeyPair();
+                    if (!keyPair) {
+                        // The private key is not extractable; IndexedDB stores the CryptoKey itself
+                        keyPair = await crypto.subtle.generateKey({ name: 'Ed25519' }, false, ['sign', 'verify']);
+                        await this._storeIdentityKeyPair(keyPair);
+                        this.logger.log('Generated a new identity key');
+                    }
+                    
+                    const rawPublicKey = new Uint8Array(await crypto.subtle.exportKey('raw', keyPair.publicKey));
+                    this.identityKeyPair = keyPair;
+                    this.identityPublicKey = this._bytesToBase64(rawPublicKey);
+                    this.identityFingerprint = await this._fingerprint(rawPublicKey);
+                    this.logger.log('Identity fingerprint:', this.identityFingerprint);
+                } catch (error) {
+                    this.logger.warn('Persistent identity unavailable in this browser:', error);
+                    this.identityKeyPair = null;
+                }
+            })();
+        }
+        return this.identityPromise;
+    }
+
+    /**
+     * Create a fresh promise for the peer's identity proof of this session
+     * @private
+     */
+    _resetIdentityProof() {
+        this.peerProofPromise = new Promise(resolve => {
+            this.peerProofResolve = resolve;
+        });
+    }
+
+    /**
+     * Build what an identity proof signs: both tokens and both X25519 keys in
+     * initiator, responder order, then the signer's role. A proof is only
+     * valid for the session it was made in.
+     * @param {boolean} signedByUs - Whether the transcript is for our proof or the peer's
+     * @param {string} peerPublicKey - The peer's base64 X25519 public key
+     * @returns {Uint8Array} - The encoded transcript
+     * @private
+     */
+    _identityTranscript(signedByUs, peerPublicKey) {
+        const ours = [this.token, this.localPublicKey];
+        const theirs = [this.peerToken, peerPublicKey];
+        const [initiator, responder] = this.isInitiator ? [ours, theirs] : [theirs, ours];
+        const signerIsInitiator = signedByUs === this.isInitiator;
+        return new TextEncoder().encode([
+            'p2pftp-identity-v2',
+            initiator[0], responder[0],
+            initiator[1], responder[1],
+            signerIsInitiator ? 'initiator' : 'responder'
+        ].join(':'));
+    }
+
+    /**
+     * Sign this session's transcript with our identity and send it to the peer
+     * @param {string} peerPublicKey - The peer's base64 X25519 public key
+     * @private
+     */
+    async _sendIdentityProof(peerPublicKey) {
+        if (!this.identityKeyPair) {
+            return;
+        }
+        try {
+            const signature = await crypto.subtle.sign(
+                { name: 'Ed25519' },
+                this.identityKeyPair.privateKey,
+                this._identityTranscript(true, peerPublicKey)
+            );
+            this.sendControlMessage({ type: 'identity-proof', signature: this._bytesToBase64(new Uint8Array(signature)) });
+        } catch (error) {
+            this.logger.warn('Could not send identity proof:', error);
+        }
+    }
+
+    /**
+     * Wait for the peer's identity proof and check it against the transcript
+     * of this session as we saw it
+     * @param {string} identityKey - The peer's announced base64 Ed25519 key
+     * @param {string} peerPublicKey - The peer's base64 X25519 public key
+     * @private
+     */
+    async _verifyPeerIdentity(identityKey, peerPublicKey) {
+        let timer;
+        const signature = await Promise.race([
+            this.peerProofPromise,
+            new Promise(resolve => {
+                timer = setTimeout(() => resolve(null), this.identityProofTimeout);
+            })
+        ]);
+        clearTimeout(timer);
+        if (!signature) {
+            this.logger.warn('Peer announced an identity but never proved it');
+            return;
+        }
+        
+        try {
+            const rawKey = this._base64ToBytes(identityKey);
+            const publicKey = await crypto.subtle.importKey('raw', rawKey, { name: 'Ed25519' }, false, ['verify']);
+            const valid = await crypto.subtle.verify(
+                { name: 'Ed25519' },
+                publicKey,
+                this._base64ToBytes(signature),
+                this._identityTranscript(false, peerPublicKey)
+            );
+            if (!valid) {
+                this.logger.warn('Peer identity signature is invalid, ignoring it');
+                return;
+            }
+            
+            this.peerIdentity = {
+                publicKey: identityKey,
+                fingerprint: await this._fingerprint(rawKey)
+            };
+            this.logger.log('Peer identity verified:', this.peerIdentity.fingerprint, this.isPeerTrusted() ? '(trusted)' : '');
+            if (this.onPeerIdentity) {
+                this.onPeerIdentity(this.peerIdentity);
+            }
+        } catch (error) {
+            this.logger.warn('Could not verify peer identity:', error);
+        }
+    }
+
+    /**
+     * Format a short, human-comparable fingerprint of an identity key
+     * @param {Uint8Array} rawPublicKey - The raw Ed25519 public key
+     * @returns {Promise<string>} - e.g. "3fa2 91bc 07de 5a44"
+     * @private
+     */
+    async _fingerprint(rawPublicKey) {
+        const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', rawPublicKey));
+        const hex = Array.from(digest.slice(0, 8), b => b.toString(16).padStart(2, '0')).join('');
+        return hex.match(/.{4}/g).join(' ');
+    }
+
+    /**
+     * Open the IndexedDB database holding the identity key
+     * @returns {Promise<IDBDatabase>}
+     * @private
+     */
+    _openIdentityStore() {
+        return new Promise((resolve, reject) => {
+            const request = indexedDB.open('p2pftp', 1);
+            request.onupgradeneeded = () => request.result.createObjectStore('identity');
+            request.onsuccess = () => resolve(request.result);
+            request.onerror = () => reject(request.error);
+        });
+    }
+
+    /**
+     * @returns {Promise<CryptoKeyPair|null>} - The stored identity key pair, if any
+     * @private
+     */
+    async _loadIdentityKeyPair() {
+        const db = await this._openIdentityStore();
+        return new Promise((resolve, reject) => {
+            const request = db.transaction('identity').objectStore('identity').get('ed25519');
+            request.onsuccess = () => resolve(request.result || null);
+            request.onerror = () => reject(request.error);
+        });
+    }
+
+    /**
+     * @param {CryptoKeyPair} keyPair - The identity key pair to persist
+     * @returns {Promise}
+     * @private
+     */
+    async _storeIdentityKeyPair(keyPair) {
+        const db = await this._openIdentityStore();
+        return new Promise((resolve, reject) => {
+            const tx = db.transaction('identity', 'readwrite');
+            tx.objectStore('identity').put(keyPair, 'ed25519');
+            tx.oncomplete = () => resolve();
+            tx.onerror = () => reject(tx.error);
+        });
+    }
+
+    /**
+     * @returns {Object} - Trusted peers from localStorage, keyed by fingerprint
+     * @private
+     */
+    _loadTrustedPeers() {
+        try {
+            return JSON.parse(localStorage.getItem('p2pftp.trustedPeers')) || {};
+        } catch (error) {
+            return {};
+        }
+    }
+
+    /**
+     * @returns {boolean} - True if the connected peer proved a trusted identity
+     * over this session's end-to-end keys
+     */
+    isPeerTrusted() {
+        return Boolean(this.encryptionEnabled && this.peerIdentity && this.trustedPeers[this.peerIdentity.fingerprint]);
+    }
+
+    /**
+     * Mark the connected peer's identity as trusted, or stop trusting it
+     * @param {boolean} trusted - Whether to trust the peer
+     * @param {string} [name] - Optional label for the peer
+     */
+    setPeerTrusted(trusted, name) {
+        if (!this.peerIdentity) {
+            throw new Error('Peer has not proven an identity');
+        }
+        
+        const fingerprint = this.peerIdentity.fingerprint;
+        if (trusted) {
+            this.trustedPeers[fingerprint] = { name: name || '', added: new Date().toISOString() };
+        } else {
+            delete this.trustedPeers[fingerprint];
+        }
+        localStorage.setItem('p2pftp.trustedPeers', JSON.stringify(this.trustedPeers));
+        this.logger.log(trusted ? 'Trusting peer' : 'No longer trusting peer', fingerprint);
+    }
+
+    /**
+     * @returns {string} - The stored auto-accept policy, 'never' by default
+     * @private
+     */
+    _loadAutoAcceptPolicy() {
+        const policy = localStorage.getItem('p2pftp.autoAccept');
+        return ['known-peers', 'all'].includes(policy) ? policy : 'never';
+    }
+
+    /**
+     * Set and remember how incoming connection requests are answered
+     * @param {string} policy - 'never' (always ask), 'known-peers' (accept
+     * requests signed by a trusted identity) or 'all'
+     */
+    setAutoAcceptPolicy(policy) {
+        if (!['never', 'known-peers', 'all'].includes(policy)) {
+            throw new Error('Auto-accept policy must be never, known-peers or all');
+        }
+        this.autoAcceptPolicy = policy;
+        localStorage.setItem('p2pftp.autoAccept', policy);
+        this.logger.log('Auto-accept policy:', policy);
+    }
+
+    /**
+     * Sign a connection request with our identity. The signature covers both
+     * tokens, so it can't be replayed for another pairing.
+     * @param {string} peerToken - The token being requested
+     * @returns {Promise<Object|null>} - { publicKey, signature }, or null without an identity
      * @private
      */
-    _setupDataChannel(channel) {
-        // Set binary type to arraybuffer
-        channel.binaryType = 'arraybuffer';
+    async _signConnectionRequest(peerToken) {
+        try {
+            await this._prepareIdentity();
+            if (!this.identityKeyPair || !this.token) {
+                return null;
+            }
+            const signature = await crypto.subtle.sign(
+                { name: 'Ed25519' },
+                this.identityKeyPair.privateKey,
+                new TextEncoder().encode(`p2pftp-request:${this.token}:${peerToken}`)
+            );
+            return {
+                publicKey: this.identityPublicKey,
+                signature: this._bytesToBase64(new Uint8Array(signature))
+            };
+        } catch (error) {
+            this.logger.warn('Could not sign connection request:', error);
+            return null;
+        }
+    }
 
-        channel.onopen = () => {
-            this.logger.log('Data channel opened');
-            if (this.onStatusChange) {
-                this.onStatusChange('Data channel opened');
+    /**
+     * Check the identity signed into a connection request
+     * @param {Object} identity - The requester's { publicKey, signature }
+     * @param {string} requestToken - The requester's token
+     * @returns {Promise<string|null>} - The requester's fingerprint, or null if unproven
+     * @private
+     */
+    async _verifyRequestIdentity(identity, requestToken) {
+        if (!identity || !identity.publicKey || !identity.signature || !this.token) {
+            return null;
+        }
+        try {
+            const rawKey = this._base64ToBytes(identity.publicKey);
+            const publicKey = await crypto.subtle.importKey('raw', rawKey, { name: 'Ed25519' }, false, ['verify']);
+            const valid = await crypto.subtle.verify(
+                { name: 'Ed25519' },
+                publicKey,
+                this._base64ToBytes(identity.signature),
+                new TextEncoder().encode(`p2pftp-request:${requestToken}:${this.token}`)
+            );
+            if (!valid) {
+                this.logger.warn('Connection request identity signature is invalid, ignoring it');
+                return null;
             }
-            
-            // Send a test message to verify the channel is working
-            const testData = new Uint8Array([0, 0, 0, 0, 0, 0, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8]);
+            return await this._fingerprint(rawKey);
+        } catch (error) {
+            this.logger.warn('Could not verify connection request identity:', error);
+            return null;
+        }
+    }
+
+    /**
+     * Answer an incoming connection request per the auto-accept policy, or
+     * hand it to the UI
+     * @param {string} requestToken - The requester's token
+     * @param {Object} [identity] - The requester's signed identity, if sent
+     * @private
+     */
+    async _handleConnectionRequest(requestToken, identity) {
+        const fingerprint = await this._verifyRequestIdentity(identity, requestToken);
+        const known = fingerprint !== null && Boolean(this.trustedPeers[fingerprint]);
+        
+        if (this.autoAcceptPolicy === 'all' || (this.autoAcceptPolicy === 'known-peers' && known)) {
+            this.logger.log(`Auto-accepting connection from ${requestToken}` + (known ? ` (trusted identity ${fingerprint})` : ''));
+            this.expectedPeerFingerprint = known ? fingerprint : null;
             try {
-                channel.send(testData);
-                this.logger.log('Test message sent successfully');
+                this.acceptConnection(requestToken);
             } catch (error) {
-                this.logger.error('Failed to send test message:', error);
+                this.logger.error('Could not auto-accept connection:', error);
             }
-        };
+            return;
+        }
+        
+        if (this.onConnectionRequest) {
+            this.onConnectionRequest(requestToken, fingerprint ? { fingerprint, trusted: known } : null);
+        } else {
+            this.logger.error('onConnectionRequest handler not set!');
+        }
+    }
 
-        channel.onclose = () => {
-            this.logger.log('Data channel closed');
-            if (this.onStatusChange) {
-                this.onStatusChange('Data channel closed');
-            }
+    /**
+     * Create a fresh promise that resolves once payload encryption is settled
+     * @private
+     */
+    _resetEncryptionPromise() {
+        this.encryptionPromise = new Promise(resolve => {
+            this.encryptionResolve = resolve;
+        });
+    }
+
+    /**
+     * Derive the shared payload key and security code from the peer's public key
+     * @param {string} peerPublicKey - The peer's base64 X25519 public key
+     * @returns {Promise} - Resolves when the key is derived
+     * @private
+     */
+    async _deriveEncryptionKey(peerPublicKey) {
+        try {
+            const peerKeyBytes = this._base64ToBytes(peerPublicKey);
+            const peerKey = await crypto.subtle.importKey('raw', peerKeyBytes, { name: 'X25519' }, false, []);
+            const sharedSecret = await crypto.subtle.deriveBits({ name: 'X25519', public: peerKey }, this.encryptionKeyPair.privateKey, 256);
             
-            // Trigger peer disconnect event if we were connected
-            if (this.connected && this.onPeerDisconnect) {
-                this.connected = false;
-                this.onPeerDisconnect();
+            // Bind the key and security code to both public keys (sorted so both sides agree)
+            const keys = [this.localPublicKey, peerPublicKey].sort();
+            const transcript = new TextEncoder().encode(keys.join(':'));
+            
+            const hkdfKey = await crypto.subtle.importKey('raw', sharedSecret, 'HKDF', false, ['deriveKey']);
+            this.encryptionKey = await crypto.subtle.deriveKey(
+                { name: 'HKDF', hash: 'SHA-256', salt: transcript, info: new TextEncoder().encode('p2pftp-chunk-payload') },
+                hkdfKey,
+                { name: 'AES-GCM', length: 256 },
+                false,
+                ['encrypt', 'decrypt']
+            );
+            
+            // Six digit short authentication string for verbal comparison
+            const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', transcript));
+            const code = ((digest[0] << 16) | (digest[1] << 8) | digest[2]) % 1000000;
+            this.securityCode = code.toString().padStart(6, '0').replace(/(\d{3})(\d{3})/, '$1 $2');
+            this.encryptionEnabled = true;
+            
+            this.logger.log('Payload encryption enabled, security code:', this.securityCode);
+            if (this.onEncryptionReady) {
+                this.onEncryptionReady(this.securityCode);
             }
-        };
-
-        channel.onerror = (error) => {
-            this.logger.error('Data channel error:', error);
+        } catch (error) {
+            this.logger.error('Failed to derive payload encryption key:', error);
+            this.encryptionEnabled = false;
             if (this.onError) {
-                this.onError('Data channel error: ' + error.message);
+                this.onError('Failed to set up payload encryption: ' + error.message);
             }
-        };
+        }
+    }
 
-        channel.onmessage = (event) => {
-            const data = event.data;
-            
-            if (data instanceof ArrayBuffer) {
-                this.logger.log(`Received binary data: ${data.byteLength} bytes`);
-                
-                // Extract transfer ID, sequence number and size if possible
-                if (data.byteLength >= 12) {
-                    const view = new DataView(data);
-                    const transferId = view.getUint32(0);
-                    const sequence = view.getUint32(4);
-                    const chunkSize = view.getUint32(8);
-                    this.logger.log(`Data appears to be chunk ${sequence} for transfer ${transferId} with size ${chunkSize}`);
-                } else if (data.byteLength >= 8) {
-                    // Legacy format without transfer ID
-                    const view = new DataView(data);
-                    const sequence = view.getUint32(0);
-                    const chunkSize = view.getUint32(4);
-                    this.logger.log(`Data appears to be legacy chunk ${sequence} with size ${chunkSize}`);
-                }
-                
-                // Pass to data handler
-                if (this.onDataMessage) {
-                    this.onDataMessage(data);
-                }
-            } else {
-                this.logger.warn('Received non-binary data on data channel:', data);
-                // Still try to pass to data handler
-                if (this.onDataMessage) {
-                    this.onDataMessage(data);
-                }
-            }
-        };
+    /**
+     * Build the AES-GCM nonce for a chunk
+     * @param {boolean} fromInitiator - True if the chunk was sent by the connection initiator
+     * @param {number} transferId - The numeric transfer ID
+     * @param {number} sequence - The chunk sequence number
+     * @returns {Uint8Array} - The 12-byte nonce
+     * @private
+     */
+    _getChunkNonce(fromInitiator, transferId, sequence) {
+        // Both directions share one key, so the sender's role keeps nonces unique
+        const nonce = new Uint8Array(12);
+        const view = new DataView(nonce.buffer);
+        view.setUint8(0, fromInitiator ? 1 : 2);
+        view.setUint32(4, transferId);
+        view.setUint32(8, sequence);
+        return nonce;
     }
 
     /**
-     * Handle capabilities message from peer
-     * @param {Object} capabilities - The capabilities message
+     * Encode bytes as base64
+     * @param {Uint8Array} bytes - The bytes to encode
+     * @returns {string} - The base64 string
      * @private
      */
-    _handleCapabilities(capabilities) {
-        const peerMaxChunkSize = capabilities.maxChunkSize || this.DEFAULT_CHUNK_SIZE;
-        
-        this.logger.log('Received capabilities from peer, max chunk size:', peerMaxChunkSize);
-        
-        // Negotiate chunk size (minimum of both peers)
-        const negotiatedSize = Math.min(this.maxChunkSize, peerMaxChunkSize);
-        
-        // Log if peer supports larger chunks than our maximum
-        if (peerMaxChunkSize > this.maxChunkSize) {
-            this.logger.log('Peer supports larger chunks than our maximum. Consider increasing our limit for better performance.');
-        }
-        
-        // Update negotiated chunk size
-        this.negotiatedChunkSize = negotiatedSize;
-        
-        // Send acknowledgment
-        this.sendCapabilitiesAck(negotiatedSize);
-        
-        // Mark capabilities as exchanged
-        this.capabilitiesExchanged = true;
-        
-        // Clear timeout and resolve promise
-        if (this.capabilitiesExchangeTimeout) {
-            clearTimeout(this.capabilitiesExchangeTimeout);
-            this.capabilitiesExchangeTimeout = null;
-        }
-        
-        if (this.capabilitiesResolve) {
-            this.capabilitiesResolve();
-            this.capabilitiesResolve = null;
-            this.capabilitiesReject = null;
+    _bytesToBase64(bytes) {
+        let binary = '';
+        for (let i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
         }
-        
-        this.logger.log('Negotiated chunk size:', negotiatedSize);
-        
-        if (this.onStatusChange) {
-            this.onStatusChange('Negotiated chunk size: ' + negotiatedSize + ' bytes');
+        return btoa(binary);
+    }
+
+    /**
+     * Decode base64 to bytes
+     * @param {string} base64 - The base64 string
+     * @returns {Uint8Array} - The decoded bytes
+     * @private
+     */
+    _base64ToBytes(base64) {
+        const binary = atob(base64);
+        const bytes = new Uint8Array(binary.length);
+        for (let i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
         }
-        
-        // Check for P2P stability and trigger disconnection
-        this._checkAndDisconnectFromServer();
+        return bytes;
     }
 
     /**
@@ -922,7 +2817,7 @@ class P2PConnection {
             return;
         }
         
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+        if (!this._canSignal()) {
             this.logger.warn('Cannot send ICE candidate: not connected to signaling server');
             return;
         }
@@ -938,8 +2833,12 @@ class P2PConnection {
             ice: JSON.stringify(candidate)
         };
         
-        this.signaler.send(JSON.stringify(message));
-        this.logger.log('Sent ICE candidate to peer');
+        try {
+            this._sendSignaling(message);
+            this.logger.log('Sent ICE candidate to peer');
+        } catch (error) {
+            this.logger.warn('Cannot send ICE candidate:', error.message);
+        }
     }
 
     /**
@@ -970,28 +2869,67 @@ class P2PConnection {
             switch (message.type) {
                 case 'token':
                     this.token = message.token;
+                    this.reconnectSecret = message.secret || null;
                     this.logger.log('Assigned token:', this.token);
+                    if (this.tokenResolve) {
+                        this.tokenResolve(this.token);
+                    }
                     if (this.onTokenReceived) {
                         this.onTokenReceived(this.token);
                     }
                     break;
                     
+                case 'pong':
+                    this.lastPong = Date.now();
+                    this.serverAnswersPing = true;
+                    break;
+                    
                 case 'error':
                     this.logger.error('Server error:', message.sdp);
+                    
+                    // A registration refused for capacity won't produce a token
+                    if (message.code && this.tokenReject) {
+                        const error = new Error(message.sdp);
+                        error.code = message.code;
+                        this.tokenReject(error);
+                    }
+                    
                     if (this.onError) {
                         this.onError('Server error: ' + message.sdp);
                     }
                     break;
                     
-                case 'request':
-                    const requestToken = message.token;
-                    this.logger.log('Connection request from:', requestToken);
-                    this.logger.debug('Connection request details - onConnectionRequest exists:', !!this.onConnectionRequest);
-                    if (this.onConnectionRequest) {
-                        this.onConnectionRequest(requestToken);
-                    } else {
-                        this.logger.error('onConnectionRequest handler not set!');
+                case 'kicked':
+                    // The operator dropped our token, so reclaiming it would fail
+                    this.logger.error('Disconnected by server:', message.sdp);
+                    this.serverDisconnected = true;
+                    this.reconnectSecret = null;
+                    if (this.onError) {
+                        this.onError('Server: ' + message.sdp);
+                    }
+                    break;
+                    
+                case 'token-expired':
+                    // The server forgot our token; register again for a new one
+                    this.logger.warn('Token expired:', message.sdp);
+                    this.reconnectSecret = null;
+                    if (this.onStatusChange) {
+                        this.onStatusChange('Token expired, registering again');
+                    }
+                    if (this.signaler) {
+                        this.signaler.onclose = null;
+                        this.signaler.close();
                     }
+                    this._stopSignalingKeepalive();
+                    this.serverConnected = false;
+                    if (!this.serverDisconnected) {
+                        this._reconnectSignaler();
+                    }
+                    break;
+                    
+                case 'request':
+                    this.logger.log('Connection request from:', message.token);
+                    this._handleConnectionRequest(message.token, message.identity);
                     break;
                     
                 case 'accepted':
@@ -1027,9 +2965,11 @@ class P2PConnection {
                     
                     // Parse the offer
                     const offer = JSON.parse(message.sdp);
+                    this._storeSignaledCapabilities(message);
                     
                     // Set remote description
                     this.peerConnection.setRemoteDescription(new RTCSessionDescription(offer))
+                        .then(() => this._prepareCapabilities())
                         .then(() => {
                             // Create answer
                             return this.peerConnection.createAnswer();
@@ -1053,6 +2993,7 @@ class P2PConnection {
                 case 'answer':
                     this.logger.log('Received answer from:', message.token);
                     const answer = JSON.parse(message.sdp);
+                    this._storeSignaledCapabilities(message);
                     this.peerConnection.setRemoteDescription(new RTCSessionDescription(answer))
                         .catch(error => {
                             this.logger.error('Error setting remote description:', error);
@@ -1098,6 +3039,165 @@ class P2PConnection {
         }
     }
 
+    /**
+     * Change the heartbeat timing. Takes effect on the next connection.
+     * @param {number} interval - ms between heartbeats
+     * @param {number} timeout - ms of silence before the peer counts as unreachable
+     */
+    setHeartbeat(interval, timeout) {
+        if (timeout <= interval) {
+            throw new Error('Heartbeat timeout must be longer than the interval');
+        }
+        this.heartbeatInterval = interval;
+        this.heartbeatTimeout = timeout;
+    }
+
+    /**
+     * Send heartbeats and watch for the peer's to stop
+     * @private
+     */
+    _startHeartbeat() {
+        this._stopHeartbeat();
+        this.lastPeerActivity = Date.now();
+        this.lastHeartbeatTick = this.lastPeerActivity;
+        
+        this.heartbeatTimer = setInterval(() => {
+            if (!this.controlChannel || this.controlChannel.readyState !== 'open') {
+                this._stopHeartbeat();
+                return;
+            }
+            
+            // A late tick means we were suspended, not that the peer went quiet
+            const now = Date.now();
+            if (now - this.lastHeartbeatTick > this.heartbeatTimeout) {
+                this.lastPeerActivity = now;
+            }
+            this.lastHeartbeatTick = now;
+            
+            this.queueControlMessage({ type: 'heartbeat' });
+            
+            const silence = now - this.lastPeerActivity;
+            if (silence > this.heartbeatTimeout && !this.peerUnreachable) {
+                this.peerUnreachable = true;
+                this.logger.warn(`Peer unreachable: no heartbeat for ${Math.round(silence / 1000)}s`);
+                if (this.onPeerReachability) {
+                    this.onPeerReachability(false);
+                }
+            }
+        }, this.heartbeatInterval);
+    }
+
+    /**
+     * @private
+     */
+    _stopHeartbeat() {
+        if (this.heartbeatTimer) {
+            clearInterval(this.heartbeatTimer);
+            this.heartbeatTimer = null;
+        }
+    }
+
+    /**
+     * Record that something arrived from the peer
+     * @private
+     */
+    _notePeerActivity() {
+        this.lastPeerActivity = Date.now();
+        if (this.peerUnreachable) {
+            this.peerUnreachable = false;
+            this.logger.log('Peer reachable again');
+            if (this.onPeerReachability) {
+                this.onPeerReachability(true);
+            }
+        }
+    }
+
+    /**
+     * Start watching for wall-clock jumps that indicate a suspend/resume
+     * @private
+     */
+    _startSleepWatchdog() {
+        this._stopSleepWatchdog();
+        this.lastSleepCheck = Date.now();
+        
+        this.sleepWatchdog = setInterval(() => {
+            const now = Date.now();
+            const gap = now - this.lastSleepCheck;
+            this.lastSleepCheck = now;
+            
+            if (gap > this.sleepGapThreshold) {
+                this._handleResumeFromSleep(gap);
+            }
+        }, this.sleepCheckInterval);
+    }
+
+    /**
+     * Stop the suspend/resume watchdog
+     * @private
+     */
+    _stopSleepWatchdog() {
+        if (this.sleepWatchdog) {
+            clearInterval(this.sleepWatchdog);
+            this.sleepWatchdog = null;
+        }
+    }
+
+    /**
+     * Validate the session after the machine wakes up and recover if possible
+     * @param {number} gap - Milliseconds since the previous watchdog tick
+     * @private
+     */
+    _handleResumeFromSleep(gap) {
+        this.logger.warn(`Detected resume from sleep (timer gap ${Math.round(gap / 1000)}s), validating connection`);
+        
+        const iceState = this.peerConnection ? this.peerConnection.iceConnectionState : 'closed';
+        const channelsOpen = this.controlChannel && this.controlChannel.readyState === 'open' &&
+                             this.dataChannel && this.dataChannel.readyState === 'open';
+        const signalerOpen = this.signaler && this.signaler.readyState === WebSocket.OPEN;
+        
+        if (this.serverConnected && !signalerOpen) {
+            this.logger.warn('Signaling connection was lost during sleep');
+        }
+        
+        if (channelsOpen && (iceState === 'connected' || iceState === 'completed')) {
+            this.logger.log('Peer connection survived sleep');
+            if (this.onResumeFromSleep) {
+                this.onResumeFromSleep(true);
+            }
+            return;
+        }
+        
+        // The channels are still usable if ICE can reconnect, which needs the signaling server
+        const iceDown = iceState === 'disconnected' || iceState === 'failed';
+        if (channelsOpen && signalerOpen && iceDown) {
+            if (this.isInitiator && this.peerConnection.restartIce) {
+                this.logger.log('Restarting ICE after resume');
+                this.iceRestartPending = true;
+                this.peerConnection.restartIce();
+                this._createAndSendOffer();
+            } else {
+                this.logger.log('Waiting for peer to restart ICE after resume');
+                this.iceRestartPending = true;
+            }
+            return;
+        }
+        
+        // We left the signaling server after connecting, and leaving it cleanly
+        // released our token, so there's nothing to reclaim and no way to
+        // negotiate the restart
+        if (channelsOpen && iceDown) {
+            this.logger.error('Cannot restart ICE after resume: no longer connected to the signaling server');
+        } else {
+            this.logger.error('Peer connection did not survive sleep, ICE state:', iceState);
+        }
+        if (this.onResumeFromSleep) {
+            this.onResumeFromSleep(false);
+        }
+        if (this.onError) {
+            this.onError('Connection lost while the computer was asleep. Please reconnect to your peer.');
+        }
+    }
+
     /**
      * Handle P2P connection failure after server disconnection
      * @private
@@ -1121,7 +3221,9 @@ class P2PConnection {
     _createAndSendOffer() {
         this.logger.log('Creating and sending offer');
         
-        this.peerConnection.createOffer()
+        // Capabilities ride along with the offer, so their keys must exist first
+        this._prepareCapabilities()
+            .then(() => this.peerConnection.createOffer())
             .then(offer => {
                 return this.peerConnection.setLocalDescription(offer);
             })
@@ -1145,7 +3247,7 @@ class P2PConnection {
      * @private
      */
     _sendOffer(offer) {
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+        if (!this._canSignal()) {
             throw new Error('Not connected to signaling server');
         }
         
@@ -1156,10 +3258,11 @@ class P2PConnection {
         const message = {
             type: 'offer',
             peerToken: this.peerToken,
-            sdp: JSON.stringify(offer)
+            sdp: JSON.stringify(offer),
+            capabilities: this._buildCapabilities()
         };
         
-        this.signaler.send(JSON.stringify(message));
+        this._sendSignaling(message);
         this.logger.log('Sent offer to peer');
     }
 
@@ -1169,7 +3272,7 @@ class P2PConnection {
      * @private
      */
     _sendAnswer(answer) {
-        if (!this.signaler || this.signaler.readyState !== WebSocket.OPEN) {
+        if (!this._canSignal()) {
             throw new Error('Not connected to signaling server');
         }
         
@@ -1180,10 +3283,11 @@ class P2PConnection {
         const message = {
             type: 'answer',
             peerToken: this.peerToken,
-            sdp: JSON.stringify(answer)
+            sdp: JSON.stringify(answer),
+            capabilities: this._buildCapabilities()
         };
         
-        this.signaler.send(JSON.stringify(message));
+        this._sendSignaling(message);
         this.logger.log('Sent answer to peer');
     }
 